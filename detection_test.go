@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLateAndSkewedMails(t *testing.T) {
+	resetConfig(t)
+	globalconf.DisableFileDeletion = true
+	globalconf.DuplicateWindow = time.Minute
+	globalconf.MailCheckTimeout = 30 * time.Second
+
+	sent := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		name              string
+		recv              time.Time
+		late, early, skew float64
+		// age observed in mail_late_mail_age_seconds, for late mails only
+		age float64
+	}{
+		// sent earlier than any probe waiting still could
+		{"late", sent.Add(time.Minute), 1, 0, 0, 60},
+		// sent recently, yet no probe waits for it
+		{"early", sent.Add(10 * time.Second), 0, 1, 0, 0},
+		// sent later than received
+		{"skewed", sent.Add(-time.Second), 0, 1, 1, 0},
+	} {
+		late := testutil.ToFloat64(lateMails.WithLabelValues(tc.name))
+		ages, ageSum := histogramOf(t, lateMailAge, tc.name)
+		early := testutil.ToFloat64(earlyMails.WithLabelValues(tc.name))
+		skew := testutil.ToFloat64(clockSkewEvents.WithLabelValues(tc.name))
+
+		// no probe waits for the token
+		dispatchMail(email{"/nonexistent", tc.name, "token-" + tc.name, sent, tc.recv}, map[string]time.Time{})
+
+		if v := testutil.ToFloat64(lateMails.WithLabelValues(tc.name)) - late; v != tc.late {
+			t.Errorf("%s: counted %g late, want %g", tc.name, v, tc.late)
+		}
+		if v := testutil.ToFloat64(earlyMails.WithLabelValues(tc.name)) - early; v != tc.early {
+			t.Errorf("%s: counted %g early, want %g", tc.name, v, tc.early)
+		}
+		if v := testutil.ToFloat64(clockSkewEvents.WithLabelValues(tc.name)) - skew; v != tc.skew {
+			t.Errorf("%s: counted %g skewed, want %g", tc.name, v, tc.skew)
+		}
+		count, sum := histogramOf(t, lateMailAge, tc.name)
+		if n := count - ages; float64(n) != tc.late || sum-ageSum != tc.age {
+			t.Errorf("%s: %d ages of %gs observed, want %g of %gs", tc.name, n, sum-ageSum, tc.late, tc.age)
+		}
+	}
+}
+
+func TestEarlyMailsByTimeoutOfConfig(t *testing.T) {
+	resetConfig(t)
+	globalconf.DisableFileDeletion = true
+	globalconf.MailCheckTimeout = 30 * time.Second
+	globalconf.Servers = []smtpServerConfig{{Name: "patient", MailCheckTimeout: 5 * time.Minute}}
+
+	// late by the global timeout, but not by the one of its config
+	early := testutil.ToFloat64(earlyMails.WithLabelValues("patient"))
+	late := testutil.ToFloat64(lateMails.WithLabelValues("patient"))
+	dispatchMail(email{"/nonexistent", "patient", "token-patient", time.Unix(1000, 0), time.Unix(1060, 0)}, map[string]time.Time{})
+	if v := testutil.ToFloat64(earlyMails.WithLabelValues("patient")) - early; v != 1 {
+		t.Errorf("counted %g early within the timeout of the config, want 1", v)
+	}
+	if v := testutil.ToFloat64(lateMails.WithLabelValues("patient")) - late; v != 0 {
+		t.Errorf("counted %g late within the timeout of the config, want 0", v)
+	}
+}
+
+// BenchmarkParseWorkers measures the throughput of parsing the mails of many servers,
+// with a single worker as the detection had before and with a pool of them.
+func BenchmarkParseWorkers(b *testing.B) {
+	resetConfig(b)
+	globalconf.PayloadSeparator = "-"
+	globalconf.MaxMailFileBytes = 1 << 20
+	globalconf.MaxMailReadBytes = 64 * 1024
+
+	dir := b.TempDir()
+	var paths []string
+	for i := 0; i < 500; i++ {
+		p, err := newPayload(fmt.Sprintf("server%d", i%50))
+		if err != nil {
+			b.Fatal(err)
+		}
+		path := filepath.Join(dir, p.token)
+		mail := "Subject: probe\r\n\r\n" + p.String() + padding(8*1024)
+		if err := os.WriteFile(path, []byte(mail), 0600); err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				queue := make(chan string)
+				parsed := make(chan email)
+				for i := 0; i < workers; i++ {
+					go parseWorker(ctx, queue, parsed)
+				}
+				go func() {
+					for _, path := range paths {
+						queue <- path
+					}
+					close(queue)
+				}()
+				for range paths {
+					<-parsed
+				}
+				cancel()
+			}
+		})
+	}
+}
+
+func TestOversizedMailSkipped(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadSeparator = "-"
+	globalconf.MaxMailFileBytes = 4096
+	globalconf.MaxMailReadBytes = 64 * 1024
+
+	p, err := newPayload("oversized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	small, large := filepath.Join(dir, "small"), filepath.Join(dir, "large")
+	os.WriteFile(small, []byte("Subject: probe\r\n\r\n"+p.String()), 0600)
+	os.WriteFile(large, []byte("Subject: probe\r\n\r\n"+p.String()+padding(4096)), 0600)
+
+	if m, err := parseMail(small); err != nil || m.token != p.token {
+		t.Errorf("mail within maxmailfilebytes not detected: %v", err)
+	}
+	if _, err := parseMail(large); err != errNotOurDept {
+		t.Errorf("mail beyond maxmailfilebytes parsed: %v", err)
+	}
+}
+
+func TestPayloadFormatsRoundTrip(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadSeparator = "-"
+	globalconf.MaxMailFileBytes = 1024 * 1024
+	globalconf.MaxMailReadBytes = 64 * 1024
+	dir := t.TempDir()
+
+	for _, format := range []string{"delimited", "json"} {
+		globalconf.PayloadFormat = format
+		p, err := newPayload("round-trip " + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := writeMail(t, dir, format, p.String()+"\r\n")
+
+		// whatever format is configured when it arrives
+		for _, parsing := range []string{"delimited", "json"} {
+			globalconf.PayloadFormat = parsing
+			m, err := parseMail(path)
+			if err != nil {
+				t.Errorf("%s payload not parsed with %s configured: %s", format, parsing, err)
+				continue
+			}
+			if m.configname != p.configname || m.token != p.token || !m.tSent.Equal(time.Unix(0, p.timestamp)) {
+				t.Errorf("%s payload parsed into %+v, want %+v", format, m, p)
+			}
+		}
+	}
+}
+
+func TestBulkyHeadersDetected(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadSeparator = "-"
+	globalconf.MaxMailFileBytes = 1024 * 1024
+	// the former limit of all of the mail
+	globalconf.MaxMailReadBytes = 8192
+
+	p, err := newPayload("bulky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headers strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&headers, "Received: from relay%d.example.com (relay%d.example.com [192.0.2.%d])\r\n\tby relay%d.example.com with ESMTPS id %064d\r\n", i, i, i, i+1, i)
+	}
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&headers, "ARC-Seal: i=%d; a=rsa-sha256; d=example.com; s=arc;\r\n\tb=%s\r\n", i+1, strings.Repeat("A", 340))
+	}
+	fmt.Fprintf(&headers, "DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=probe;\r\n\tb=%s\r\n", strings.Repeat("B", 340))
+	if headers.Len() <= 8192 {
+		t.Fatalf("headers of %d bytes not bulky enough", headers.Len())
+	}
+
+	path := filepath.Join(t.TempDir(), "bulky")
+	if err := os.WriteFile(path, []byte(headers.String()+"Subject: probe\r\n\r\n"+p.String()+"\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := parseMail(path); err != nil || m.token != p.token {
+		t.Errorf("mail with %d bytes of headers not detected: %v", headers.Len(), err)
+	}
+}
+
+func TestTransformedMailsDetected(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadSeparator = "-"
+	globalconf.MaxMailFileBytes = 1024 * 1024
+	globalconf.MaxMailReadBytes = 64 * 1024
+
+	p, err := newPayload("transformed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := p.String()
+	mails := map[string]string{
+		"footer": "Subject: probe\r\n\r\n" + payload + "\r\n\r\n-- \r\nSent via the list probes@example.com\r\n",
+		"quoted": "Subject: probe\r\n\r\nThe mail below was forwarded to you:\r\n\r\n" + payload + "\r\n",
+		"alternative": "Subject: probe\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=alt\r\n\r\n" +
+			"--alt\r\nContent-Type: text/plain; charset=us-ascii\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" + payload + "\r\n" +
+			"--alt\r\nContent-Type: text/html; charset=us-ascii\r\n\r\n<html><body><p>" + payload + "</p></body></html>\r\n" +
+			"--alt--\r\n",
+		"nested": "Subject: probe\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+			"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+			"--inner\r\nContent-Type: text/plain; charset=us-ascii\r\nContent-Transfer-Encoding: base64\r\n\r\n" + base64.StdEncoding.EncodeToString([]byte(payload)) + "\r\n" +
+			"--inner--\r\n" +
+			"--outer\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\nThis list is run by example.com\r\n" +
+			"--outer--\r\n",
+	}
+
+	dir := t.TempDir()
+	for name, content := range mails {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := parseMail(path); err != nil || m.token != p.token {
+			t.Errorf("%s mail not detected: %v", name, err)
+		}
+	}
+}
+
+func TestFilenamePattern(t *testing.T) {
+	resetConfig(t)
+	patterned, plain, shared := t.TempDir(), t.TempDir(), t.TempDir()
+	globalconf.Servers = []smtpServerConfig{
+		{Name: "patterned", Detectiondir: patterned, FilenamePattern: "*.mail"},
+		{Name: "plain", Detectiondir: plain},
+		// a file claimed by one server but not matching its pattern is still a candidate for another
+		{Name: "shared-patterned", Detectiondir: shared, FilenamePattern: "*.mail"},
+		{Name: "shared-plain", Detectiondir: shared},
+	}
+	for path, want := range map[string]bool{
+		filepath.Join(patterned, "1.mail"):          true,
+		filepath.Join(patterned, "1.mail.tmp"):      false,
+		filepath.Join(patterned, ".1.mail.swp"):     false,
+		filepath.Join(plain, "1.tmp"):               true,
+		filepath.Join(shared, "1.tmp"):              true,
+		filepath.Join(t.TempDir(), "unclaimed.tmp"): true,
+	} {
+		if got := isCandidate(path); got != want {
+			t.Errorf("%s a candidate: %t, want %t", path, got, want)
+		}
+	}
+
+	stub := newSMTPStub(t)
+	c := detectConfig(t, stubConfig(stub, "pattern", `filenamepattern: "*.stub"`))[0]
+	late := testutil.ToFloat64(lateMails.WithLabelValues(c.Name)) + testutil.ToFloat64(earlyMails.WithLabelValues(c.Name))
+
+	// a mail of the server not matching its pattern is left alone, neither counted nor deleted
+	p, err := newPayload(c.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := writeMail(t, filepath.Join(stub.maildir, "tmp"), "foreign.eml", p.String())
+	if err := os.Rename(foreign, filepath.Join(stub.maildir, "new", "foreign.eml")); err != nil {
+		t.Fatal(err)
+	}
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("mail matching the filenamepattern not detected: %s", r.Error)
+	}
+	// waits for mails still being parsed
+	stopDetection()
+
+	if _, err := os.Stat(filepath.Join(stub.maildir, "new", "foreign.eml")); err != nil {
+		t.Errorf("mail not matching the filenamepattern touched: %s", err)
+	}
+	if v := testutil.ToFloat64(lateMails.WithLabelValues(c.Name)) + testutil.ToFloat64(earlyMails.WithLabelValues(c.Name)); v != late {
+		t.Errorf("%g mails not matching the filenamepattern counted", v-late)
+	}
+}
+
+func TestDetectionLatencyRecorded(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadSeparator = "-"
+	globalconf.MaxMailFileBytes = 4096
+	globalconf.MaxMailReadBytes = 4096
+	globalconf.DisableFileDeletion = true
+	clock := fakeClock(t, time.Unix(2000, 0))
+
+	p, err := newPayload("latency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := make(chan email, 1)
+	muxer[p.token] = reports
+	t.Cleanup(func() { delete(muxer, p.token) })
+	count, sum := histogramOf(t, detectionDuration, "latency")
+
+	m, err := parseMail(writeMail(t, t.TempDir(), "latency", p.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	*clock = clock.Add(25 * time.Millisecond)
+	dispatchMail(m, map[string]time.Time{})
+
+	if len(reports) != 1 {
+		t.Fatal("mail not handed over to its probe")
+	}
+	newCount, newSum := histogramOf(t, detectionDuration, "latency")
+	if newCount != count+1 || math.Abs(newSum-sum-0.025) > 1e-9 {
+		t.Errorf("detection took %d times %gs in total, want once 0.025s", newCount-count, newSum-sum)
+	}
+}
+
+func TestDuplicateDeliveryCountedOnce(t *testing.T) {
+	resetConfig(t)
+	globalconf.DisableFileDeletion = true
+	globalconf.DuplicateWindow = time.Minute
+	clock := fakeClock(t, time.Unix(2000, 0))
+
+	late := testutil.ToFloat64(lateMails.WithLabelValues("duplicate"))
+	delivered := map[string]time.Time{}
+	m := email{"/nonexistent", "duplicate", "token-duplicate", time.Unix(1000, 0), time.Unix(2000, 0)}
+
+	dispatchMail(m, delivered)
+	dispatchMail(m, delivered)
+	if v := testutil.ToFloat64(lateMails.WithLabelValues("duplicate")) - late; v != 1 {
+		t.Errorf("mail delivered twice counted %g times, want once", v)
+	}
+
+	// counted again once the duplicatewindow passed
+	*clock = clock.Add(2 * time.Minute)
+	dispatchMail(m, delivered)
+	if v := testutil.ToFloat64(lateMails.WithLabelValues("duplicate")) - late; v != 2 {
+		t.Errorf("mail delivered again after the duplicatewindow counted %g times, want twice", v)
+	}
+}
+
+// writeMail writes a mail with the given body to a file named name in dir and returns its path.
+func writeMail(t *testing.T, dir string, name string, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("Subject: probe\r\n\r\n"+body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStaleMailSwept(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadSeparator = "-"
+	globalconf.MaxMailFileBytes = 1 << 20
+	globalconf.MaxMailReadBytes = 64 * 1024
+	clock := fakeClock(t, time.Unix(1000, 0))
+	dir := t.TempDir()
+
+	// no probe knows the token of either
+	stale, err := newPayload("sweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*clock = clock.Add(time.Hour)
+	fresh, err := newPayload("sweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalePath := writeMail(t, dir, "stale", stale.String())
+	freshPath := writeMail(t, dir, "fresh", fresh.String())
+	foreignPath := writeMail(t, dir, "foreign", "not a probing-mail")
+	swept := testutil.ToFloat64(staleMailsSwept.WithLabelValues("sweep"))
+
+	sweepDir(dir, 30*time.Minute)
+
+	if _, err := os.Stat(stalePath); !os.IsNotExist(err) {
+		t.Errorf("stale probing-mail not swept: %v", err)
+	}
+	for _, path := range []string{freshPath, foreignPath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s swept: %s", filepath.Base(path), err)
+		}
+	}
+	if d := testutil.ToFloat64(staleMailsSwept.WithLabelValues("sweep")) - swept; d != 1 {
+		t.Errorf("%g mails counted swept, want 1", d)
+	}
+}
+
+func TestSweepingStopsOnShutdown(t *testing.T) {
+	resetConfig(t)
+	globalconf.MailCheckTimeout = time.Hour
+	globalconf.StaleMailFactor = 2
+	globalconf.Servers = []smtpServerConfig{{Name: "sweep"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		sweepStaleMails(ctx)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("sweeping kept running after shutdown")
+	}
+}
+
+func TestNonexistentDetectionDirNotWatched(t *testing.T) {
+	resetConfig(t)
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "nonexistent")
+	globalconf.Servers = []smtpServerConfig{
+		{Name: "watch-present", Detectiondir: dir},
+		{Name: "watch-missing", Detectiondir: missing},
+	}
+
+	watcher, unwatched, err := newDetectionWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcherClose(watcher)
+
+	if !unwatched[missing] || unwatched[dir] {
+		t.Errorf("unwatched directories %v, want only %s", unwatched, missing)
+	}
+	if v := testutil.ToFloat64(detectionWatchUp.WithLabelValues("watch-missing")); v != 0 {
+		t.Errorf("watch of a nonexistent directory up %g, want 0", v)
+	}
+	if v := testutil.ToFloat64(detectionWatchUp.WithLabelValues("watch-present")); v != 1 {
+		t.Errorf("watch of an existing directory up %g, want 1", v)
+	}
+}
+
+// shortRetries shortens watcherRetryInterval until the test ends.
+func shortRetries(t *testing.T) {
+	saved := watcherRetryInterval
+	watcherRetryInterval = 20 * time.Millisecond
+	t.Cleanup(func() { watcherRetryInterval = saved })
+}
+
+func TestUpWhileWatcherDead(t *testing.T) {
+	shortRetries(t)
+	stub := newSMTPStub(t)
+	// the watcher can't be recreated while the detectiondir is missing
+	c := detectConfig(t, "failonwatcherror: true\n"+stubConfig(stub, "dead-watcher"))[0]
+	exporterUp.Set(1)
+	t.Cleanup(func() { exporterUp.Set(0) })
+	waitUp := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(exporterUp) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("mailexporter_up never became %g", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	dir := filepath.Join(stub.maildir, "new")
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(detectionWatchUp.WithLabelValues(c.Name)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("removal of the detectiondir never noticed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	detectionWatcher.Close()
+	waitUp(0)
+	// several attempts to recreate the watcher fail meanwhile
+	time.Sleep(10 * watcherRetryInterval)
+	if v := testutil.ToFloat64(exporterUp); v != 0 {
+		t.Fatalf("mailexporter_up %g while the watcher can't be recreated", v)
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	waitUp(1)
+	if v := testutil.ToFloat64(detectionWatchUp.WithLabelValues(c.Name)); v != 1 {
+		t.Errorf("watch of the recreated detectiondir up %g, want 1", v)
+	}
+}
+
+func TestDetectionResumedWithRecreatedWatcher(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := detectConfig(t, stubConfig(stub, "recreated-watcher"))[0]
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed before the watcher died: %s", r.Error)
+	}
+
+	// recreating the watcher is attempted at once, the interval is only waited after failures;
+	// the new one sets mail_detection_watch_up again, telling when mails are watched for
+	detectionWatchUp.WithLabelValues(c.Name).Set(-1)
+	detectionWatcher.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(detectionWatchUp.WithLabelValues(c.Name)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("filesystem-watcher never recreated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("mail not detected after the watcher died: %s", r.Error)
+	}
+}
+
+func TestDetectionDirRecreated(t *testing.T) {
+	shortRetries(t)
+	for name, vanish := range map[string]func(dir string) error{
+		"removed": os.RemoveAll,
+		"renamed": func(dir string) error { return os.Rename(dir, dir+".old") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			stub := newSMTPStub(t)
+			c := detectConfig(t, stubConfig(stub, "recreated-"+name))[0]
+			watchUp := func(want float64) {
+				t.Helper()
+				deadline := time.Now().Add(5 * time.Second)
+				for testutil.ToFloat64(detectionWatchUp.WithLabelValues(c.Name)) != want {
+					if time.Now().After(deadline) {
+						t.Fatalf("mail_detection_watch_up never became %g", want)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			if r := probe(context.Background(), c); !r.Success {
+				t.Fatalf("probe failed before the detectiondir vanished: %s", r.Error)
+			}
+
+			dir := filepath.Join(stub.maildir, "new")
+			if err := vanish(dir); err != nil {
+				t.Fatal(err)
+			}
+			watchUp(0)
+			if err := os.Mkdir(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			// mails delivered before the recreated directory is watched again are found then
+			if r := probe(context.Background(), c); !r.Success {
+				t.Fatalf("mail not detected in the recreated detectiondir: %s", r.Error)
+			}
+			watchUp(1)
+		})
+	}
+}
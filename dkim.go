@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimSigners holds the key of every config with DKIMKeyFile, loaded on startup.
+var dkimSigners = make(map[string]crypto.Signer)
+
+// loadDKIMKey reads the PEM-encoded RSA private key at path, in PKCS#1- or PKCS#8-form.
+func loadDKIMKey(path string) (crypto.Signer, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("no PEM-encoded key found in " + path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("only RSA keys are supported")
+	}
+	return rsaKey, nil
+}
+
+// dkimSign prepends a DKIM-Signature header to fullmail if config c signs its probing-mails.
+func dkimSign(c smtpServerConfig, fullmail string) (string, error) {
+	signer, ok := dkimSigners[c.Name]
+	if !ok {
+		return fullmail, nil
+	}
+
+	var b bytes.Buffer
+	err := dkim.Sign(&b, strings.NewReader(fullmail), &dkim.SignOptions{
+		Domain:   c.DKIMDomain,
+		Selector: c.DKIMSelector,
+		Signer:   signer,
+	})
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+func TestDKIMSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the record published under the selector
+	lookup := &dkim.VerifyOptions{LookupTXT: func(domain string) ([]string, error) {
+		if domain != "probe._domainkey.example.com" {
+			t.Errorf("key looked up at %s", domain)
+		}
+		return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+	}}
+
+	for form, der := range map[string][]byte{
+		"RSA PRIVATE KEY": x509.MarshalPKCS1PrivateKey(key),
+		"PRIVATE KEY":     pkcs8,
+	} {
+		keyFile := filepath.Join(t.TempDir(), "dkim.pem")
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: form, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		stub := newSMTPStub(t)
+		c := probeConfig(t, stub, "dkim", "dkimdomain: example.com", "dkimselector: probe", "dkimkeyfile: "+keyFile)
+		if r := probe(context.Background(), c); !r.Success {
+			t.Fatalf("probe signed with a %s failed: %s", form, r.Error)
+		}
+		stub.mu.Lock()
+		signed := stub.messages[0]
+		stub.mu.Unlock()
+
+		verifications, err := dkim.VerifyWithOptions(bytes.NewReader(signed), lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(verifications) != 1 || verifications[0].Err != nil || verifications[0].Domain != "example.com" {
+			t.Fatalf("signature with a %s not verified: %+v in\n%s", form, verifications, signed)
+		}
+
+		// any change to the signed body breaks it
+		tampered := bytes.Replace(signed, []byte("\n\n"), []byte("\n\ntampered "), 1)
+		verifications, err = dkim.VerifyWithOptions(bytes.NewReader(tampered), lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(verifications) != 1 || verifications[0].Err == nil {
+			t.Errorf("signature with a %s verified for a tampered body", form)
+		}
+	}
+}
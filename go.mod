@@ -1,9 +1,13 @@
 module github.com/cherti/mailexporter
 
-go 1.14
+go 1.21
 
 require (
+	github.com/abbot/go-http-auth v0.4.0
+	github.com/emersion/go-msgauth v0.5.0
 	github.com/prometheus/client_golang v1.7.1
+	golang.org/x/crypto v0.0.0-20190411191339-88737f569e3a
+	golang.org/x/net v0.0.0-20190613194153-d28f0bde5980
 	gopkg.in/fsnotify.v1 v1.4.7
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// logLevel is the level below which log messages are discarded.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging installs the default logger writing to stdout in the given format,
+// which is either "text" or "json".
+func setupLogging(format string, timestamps bool) error {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if !timestamps {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(os.Stdout, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stdout, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs msg with the given attributes as error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
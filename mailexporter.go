@@ -2,43 +2,206 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
 	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
 	"net/mail"
+	"net/textproto"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"smtp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
-	"smtp"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/proxy"
 	"gopkg.in/fsnotify.v1"
 	"gopkg.in/yaml.v2"
 )
 
+// build information, to be injected via -ldflags "-X main.buildVersion=... -X main.buildRevision=..."
 var (
-	logInfo  = log.New(os.Stdout, "", 0)
-	logWarn  = log.New(os.Stdout, "WARNING: ", 0)
-	logDebug = log.New(os.Stdout, "DEBUG: ", 0)
-	logError = log.New(os.Stdout, "ERROR: ", 0)
+	buildVersion  = "dev"
+	buildRevision = "unknown"
 )
 
+// exampleConfig is the commented example configuration printed by -config.generate,
+// documenting all settings.
+//
+//go:embed mailexporter.conf
+var exampleConfig string
+
+// now is the clock timestamps and durations of probes and mails are taken from,
+// replaceable to drive them deterministically.
+var now = time.Now
+
 var tokenLength = 40 // length of token for probing-mails
 const tokenChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
+// separatorChars are the characters allowed in the PayloadSeparator: the punctuation of
+// RFC 5322 atext, i.e. the characters valid in a Message-ID which are not in tokenChars.
+const separatorChars = "!#$%&'*+-/=?^_`{|}~"
+
 // muxer is used to map probe-tokens to channels where the detection-goroutine should put the found mails.
+// It is only ever accessed by the detection-goroutine, others go via registerToken and disposeToken.
 var muxer = make(map[string]chan email)
 
+// registration announces a token to wait for mails with together with the channel to report them on.
+type registration struct {
+	token   string
+	reports chan email
+}
+
+// registerToken is used in probe to announce new tokens to wait for mails for
+var registerToken = make(chan registration)
+
 // disposeToken is used in probe to announce which tokens are no longer used for waiting for mails
 var disposeToken = make(chan string)
 
+// detectionStopped is closed once the detection-goroutine stopped on shutdown, so that
+// probes still running don't block on announcing their tokens anymore.
+var detectionStopped = make(chan struct{})
+
+// announceToken registers r with the detection-goroutine unless it stopped.
+func announceToken(r registration) {
+	select {
+	case registerToken <- r:
+	case <-detectionStopped:
+	}
+}
+
+// releaseToken disposes token with the detection-goroutine unless it stopped.
+func releaseToken(token string) {
+	select {
+	case disposeToken <- token:
+	case <-detectionStopped:
+	}
+}
+
+// probeSlots limits the number of concurrent SMTP-connections if MaxConcurrentProbes is set,
+// nil otherwise.
+var probeSlots chan struct{}
+
+// acquireProbeSlot blocks until a further SMTP-connection may be opened.
+func acquireProbeSlot() {
+	if probeSlots != nil {
+		probeSlots <- struct{}{}
+	}
+}
+
+// releaseProbeSlot frees a slot taken by acquireProbeSlot.
+func releaseProbeSlot() {
+	if probeSlots != nil {
+		<-probeSlots
+	}
+}
+
+// errRateLimited is returned by send if the server's MaxSendsPerMinute is exhausted.
+var errRateLimited = errors.New("send budget exhausted")
+
+// sendBudget is a token bucket holding the sends a server may still make right away.
+type sendBudget struct {
+	tokens float64
+	last   time.Time
+}
+
+// sendBudgets holds the sendBudget of every config with MaxSendsPerMinute.
+var sendBudgets = struct {
+	sync.Mutex
+	configs map[string]*sendBudget
+}{configs: make(map[string]*sendBudget)}
+
+// takeSend consumes a send from the budget of config c, telling if there was one left.
+// The budget refills steadily to at most MaxSendsPerMinute sends.
+func takeSend(c smtpServerConfig) bool {
+	if c.MaxSendsPerMinute == 0 {
+		return true
+	}
+
+	sendBudgets.Lock()
+	defer sendBudgets.Unlock()
+
+	max := float64(c.MaxSendsPerMinute)
+	t := now()
+	b, ok := sendBudgets.configs[c.Name]
+	if !ok {
+		b = &sendBudget{tokens: max, last: t}
+		sendBudgets.configs[c.Name] = b
+	}
+
+	b.tokens = math.Min(max, b.tokens+t.Sub(b.last).Minutes()*max)
+	b.last = t
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// maintenance holds the names of the configs currently put into maintenance via HTTP.
+var maintenance = struct {
+	sync.Mutex
+	configs map[string]bool
+}{configs: make(map[string]bool)}
+
+// setMaintenance puts the named config into or out of maintenance.
+func setMaintenance(name string, on bool) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	if on {
+		maintenance.configs[name] = true
+		mailMaintenance.WithLabelValues(name).Set(1)
+	} else {
+		delete(maintenance.configs, name)
+		mailMaintenance.WithLabelValues(name).Set(0)
+	}
+}
+
+// inMaintenance tells if the named config is currently in maintenance.
+func inMaintenance(name string) bool {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	return maintenance.configs[name]
+}
+
+// payloadVersion tags the format of the payloads composed by this build, so that
+// future formats can be told apart from mails of an older one still in flight.
+const payloadVersion = "v1"
+
+// payloadHeader is the header carrying the payload in addition to the body if PayloadHeader is set.
+const payloadHeader = "X-Mailexporter-Payload"
+
 type payload struct {
 	token      string
 	timestamp  int64
@@ -47,21 +210,73 @@ type payload struct {
 
 // newPayload composes a payload to be used in probing mails for identification consisting
 // of config name, unix time and a unique token for identification and returns it.
-func newPayload(confname string) payload {
+func newPayload(confname string) (payload, error) {
 	//timestamp := strconv.FormatInt(time.Now().UnixNano(), 10)
 
 	// Now get the token to have a unique token.
-	token := generateToken(tokenLength)
+	token, err := generateToken(tokenLength)
+	if err != nil {
+		return payload{}, err
+	}
 
 	//payload = strings.Join([]string{name, token, time.Now().UnixNano()}, "-")
-	p := payload{token, time.Now().UnixNano(), confname}
-	logDebug.Println("composed payload:", p)
+	p := payload{token, now().UnixNano(), confname}
+	slog.Debug("composed payload", "payload", p)
+
+	return p, nil
+}
 
-	return p
+// jsonPayload is the representation of a payload in PayloadFormat json.
+type jsonPayload struct {
+	Version string `json:"version"`
+	Name    string `json:"name"`
+	Token   string `json:"token"`
+	Sent    int64  `json:"sent"`
 }
 
 func (p payload) String() string {
-	return strings.Join([]string{p.token, p.timestring(), p.configname}, "-")
+	if globalconf.PayloadFormat == "json" {
+		// marshalling a struct of strings and ints cannot fail
+		raw, _ := json.Marshal(jsonPayload{payloadVersion, p.configname, p.token, p.timestamp})
+		return signPayload(string(raw))
+	}
+	return signPayload(strings.Join([]string{payloadVersion, p.token, p.timestring(), p.configname}, globalconf.PayloadSeparator))
+}
+
+// payloadMAC returns the hex-encoded HMAC-SHA256 of raw keyed with the PayloadSecret.
+func payloadMAC(raw string) string {
+	mac := hmac.New(sha256.New, []byte(globalconf.PayloadSecret))
+	mac.Write([]byte(raw))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signPayload appends the MAC of raw to it if a PayloadSecret is configured.
+func signPayload(raw string) string {
+	if globalconf.PayloadSecret == "" {
+		return raw
+	}
+	return raw + globalconf.PayloadSeparator + payloadMAC(raw)
+}
+
+// verifyPayload checks the MAC appended to input if a PayloadSecret is configured
+// and returns input without it.
+func verifyPayload(input string) (string, error) {
+	if globalconf.PayloadSecret == "" {
+		return input, nil
+	}
+
+	// the hex-encoded MAC can never contain the separator
+	i := strings.LastIndex(input, globalconf.PayloadSeparator)
+	if i < 0 {
+		return "", errNotOurDept
+	}
+
+	raw, mac := input[:i], input[i+len(globalconf.PayloadSeparator):]
+	if !hmac.Equal([]byte(mac), []byte(payloadMAC(raw))) {
+		slog.Debug("payload signature mismatch")
+		return "", errNotOurDept
+	}
+	return raw, nil
 }
 
 func (p payload) timestring() string {
@@ -71,68 +286,362 @@ func (p payload) timestring() string {
 // decomposePayload returns the config name and unix timestamp as appropriate types
 // from given payload.
 func decomposePayload(input []byte) (payload, error) {
-	logDebug.Println("payload to decompose:", input)
+	slog.Debug("payload to decompose", "payload", string(input))
+
+	// a payload is always sent on a line of its own, so this is at most part of one
+	if bytes.ContainsAny(input, "\r\n") {
+		return payload{}, errNotOurDept
+	}
+
+	raw, err := verifyPayload(string(input))
+	if err != nil {
+		return payload{}, err
+	}
+
+	// both formats are always accepted to not lose mails in flight when switching
+	if strings.HasPrefix(raw, "{") {
+		return decomposeJSONPayload(raw)
+	}
+
+	version := strings.SplitN(raw, globalconf.PayloadSeparator, 2)
+	if len(version) != 2 {
+		slog.Debug("no payload version found")
+		return payload{}, errNotOurDept
+	}
+
+	switch version[0] {
+	case "v1":
+		return decomposePayloadV1(version[1])
+	default:
+		slog.Debug("unknown payload version", "version", version[0])
+		return payload{}, errNotOurDept
+	}
+}
+
+// decomposeJSONPayload decomposes a payload in PayloadFormat json.
+func decomposeJSONPayload(input string) (payload, error) {
+	var jp jsonPayload
+	if err := json.Unmarshal([]byte(input), &jp); err != nil {
+		slog.Debug("no valid json payload", "err", err)
+		return payload{}, errNotOurDept
+	}
 
-	decomp := strings.SplitN(string(input), "-", 3)
+	if jp.Version != "v1" {
+		slog.Debug("unknown payload version", "version", jp.Version)
+		return payload{}, errNotOurDept
+	}
+
+	if jp.Token == "" || jp.Name == "" {
+		slog.Debug("incomplete json payload")
+		return payload{}, errNotOurDept
+	}
+
+	return payload{jp.Token, jp.Sent, jp.Name}, nil
+}
+
+// decomposePayloadV1 decomposes the token-timestamp-configname format following the version tag.
+func decomposePayloadV1(input string) (payload, error) {
+	decomp := strings.SplitN(input, globalconf.PayloadSeparator, 3)
 	// is it correctly parsable?
 	if len(decomp) != 3 {
-		logDebug.Println("no fitting decomp")
+		slog.Debug("no fitting decomp")
 		return payload{}, errNotOurDept
 	}
 
 	extractedUnixTime, err := strconv.ParseInt(decomp[1], 10, 64)
 	// is the last one a unix-timestamp?
 	if err != nil {
-		logDebug.Println("unix-timestamp-parse-error")
+		slog.Debug("unix-timestamp-parse-error")
 		return payload{}, errNotOurDept
 	}
 
 	return payload{decomp[0], extractedUnixTime, decomp[2]}, nil
 }
 
-// holds a configuration of external server to send test mails
-var globalconf struct {
+// config holds the settings of mailexporter and the external servers to send test mails via.
+// It is a named type so that errors about unknown keys stay readable.
+type config struct {
 	// The time to wait between probe-attempts.
 	MonitoringInterval time.Duration
+	// Fraction by which the interval between probes is varied randomly each cycle,
+	// e.g. 0.1 for ±10%; disabled if 0.
+	IntervalJitter float64
+	// The delay between the first probes of subsequent servers; all start at once if 0
+	// and at random within 20s if unset.
+	StartupOffset *time.Duration
 	// The time to wait until mail_deliver_success = 0 is reported.
 	MailCheckTimeout time.Duration
+	// Log messages below this level (debug, info, warn, error) are discarded, unless overridden by -log.level.
+	LogLevel string
+	// Number of times sending a probing-mail is retried on transient errors before the probe fails.
+	SendRetries int
+	// Wait before the first retry, doubled for each further one; defaults to 1s.
+	SendRetryBackoff time.Duration
+	// Deadline for the SMTP-conversation of each attempt to send a probing-mail from connecting
+	// up to the acceptance of the mail, so that stalling servers can't hold up probes; none if 0.
+	SendTimeout time.Duration
+	// Limits the number of SMTP-connections for probing open at the same time; unlimited if 0.
+	MaxConcurrentProbes int
+	// Format of the payloads of probing-mails, either delimited (default) or json.
+	PayloadFormat string
+	// Separator between the fields of delimited payloads; defaults to "-".
+	PayloadSeparator string
+	// Also puts the payload into an X-Mailexporter-Payload header of probing-mails.
+	PayloadHeader bool
+	// text/template for the subject of probing-mails, given the server's Name and the Token;
+	// defaults to "mailexporter-probe".
+	Subject string
+	// Domain the Message-IDs of probing-mails are composed with; the domain of the sender if empty.
+	MessageIDDomain string
+	// Shared secret to sign payloads with, so that only mails sent by us are considered ours.
+	PayloadSecret string
+	// Number of goroutines parsing detected mails concurrently; defaults to the number of CPUs.
+	ParseWorkers int
+	// Number of bytes of the body of a mail read when looking for the payload; defaults to 64KiB.
+	MaxMailReadBytes int64
+	// Files in the Detectiondirs larger than this are skipped without being read; defaults to 32MiB.
+	MaxMailFileBytes int64
+	// Exits on startup if a Detectiondir cannot be watched instead of only warning.
+	FailOnWatchError bool
 	// Disables deletion of probing-mails found
 	DisableFileDeletion bool
+	// Probing-mails older than StaleMailFactor times MailCheckTimeout can never be matched
+	// anymore and are swept from the Detectiondirs; sweeping is disabled if 0.
+	StaleMailFactor int
+	// Directory to move detected probing-mails to instead of deleting them, e.g. for debugging.
+	ArchiveDir string
+	// The time during which repeated deliveries of an already detected probing-mail
+	// are ignored; defaults to MailCheckTimeout.
+	DuplicateWindow time.Duration
+	// htpasswd-file holding the users allowed to access the HTTP-endpoint; auth is disabled if empty
+	HtpasswdFile string
+	// Single user allowed to access the HTTP-endpoint if no HtpasswdFile is given.
+	AuthUser string
+	// Plaintext passphrase of AuthUser, only used if AuthPassHash is empty.
+	AuthPass string
+	// bcrypt-hash of the passphrase of AuthUser.
+	AuthPassHash string
+	// Address to listen on for the HTTP-endpoint, overriding -web.listen-address if set.
+	ListenAddress string
+	// URL of a SOCKS5- or HTTP-proxy to connect to the SMTP-servers through; direct if empty.
+	Proxy string
+	// Certificate and key to serve the HTTP-endpoint via TLS; TLS is disabled if empty.
+	CrtPath string
+	KeyPath string
+	// Serves the HTTP-endpoint via TLS with a self-signed certificate generated on startup
+	// instead of CrtPath and KeyPath; for testing only.
+	GenerateSelfSignedCert bool
+	// Minimum TLS version accepted by the HTTP-endpoint; defaults to 1.2.
+	TLSMinVersion string
+	// Names of the cipher suites accepted for TLS up to 1.2; Go's defaults if empty.
+	CipherSuites []string
+	// CA to verify client certificates against; if set, clients must present a
+	// valid certificate instead of authenticating via basic auth.
+	ClientCAPath string
+	// Suspends probing of configs while they are in maintenance.
+	PauseProbesInMaintenance bool
+
+	// Pushgateway to push the metrics to in addition to serving them; nothing is pushed if unset.
+	Pushgateway *pushgatewayConfig
+
+	// Number of most recent deliveries the SLOs of a server are evaluated over.
+	SLOWindow int
 
 	// SMTP-Servers used for probing.
 	Servers []smtpServerConfig
 }
 
+// globalconf is the configuration in use
+var globalconf config
+
 type smtpServerConfig struct {
 	// The name the probing attempts via this server are classified with.
 	Name string
-	// The address of the SMTP-server.
+	// Disabled servers are ignored entirely, as if they were not configured; defaults to true.
+	Enabled *bool
+	// The address of the SMTP-server, or unix:// followed by the path of the socket of a local one.
 	Server string
+	// Local host:port of a TLS-tunnel to the SMTP-server to connect to instead of Server and Port.
+	TunnelVia string
 	// The port of the SMTP-server.
 	Port string
+	// Overrides the global Proxy for this server if set.
+	Proxy string
+	// Forces connecting via IPv4 (tcp4) or IPv6 (tcp6) on dual-stack hosts; either if tcp or empty.
+	Network string
+	// Local IP-address to connect to the SMTP-server (or proxy) from; chosen by the system if empty.
+	SourceAddress string
+	// The name to introduce ourselves with in EHLO/HELO; "localhost" if empty.
+	HelloName string
+	// Overrides the global MessageIDDomain for this server if set.
+	MessageIDDomain string
 	// The username for the SMTP-server.
 	Login string
 	// The SMTP-user's passphrase.
 	Passphrase string
-	// The sender-address for the probing mails.
-	From string
-	// The destination the probing-mails are sent to.
-	To string
+	// SASL-mechanism to authenticate with, plain (default) or xoauth2.
+	AuthMechanism string
+	// Static bearer token for xoauth2; fetched from OAuthTokenURL if empty.
+	OAuthToken string
+	// Token endpoint and client credentials to obtain tokens for xoauth2 from
+	// via the client-credentials grant, requesting OAuthScopes.
+	OAuthTokenURL     string
+	OAuthClientID     string
+	OAuthClientSecret string
+	OAuthScopes       []string
+	// The sender-addresses for the probing mails, a single address or a list rotated through per probe.
+	From addressList
+	// Display name put into the From-header of the probing-mails along with the sender-address.
+	FromName string
+	// The destinations the probing-mails are sent to, a single address or a list.
+	To addressList
+	// Further headers added to the probing-mails, e.g. to route them through specific pipelines.
+	Headers map[string]string
+	// Keeps the connection to the SMTP-server open to be reused by the next probe.
+	ReuseConnection bool
+	// Maximum number of probing-mails sent via this server per minute; unlimited if 0.
+	MaxSendsPerMinute int
+	// Number of bytes of filler appended to the body after the payload, to probe with larger mails.
+	PayloadPadding int
+	// Accepts any certificate of the SMTP-server on STARTTLS, e.g. self-signed ones of internal relays.
+	InsecureSkipVerify bool
+	// PEM-encoded CA-certificates to verify the SMTP-server's certificate with instead of the system's.
+	CAFile string
+	// Certificate and key to authenticate with on STARTTLS to SMTP-servers requiring mutual TLS.
+	ClientCertFile string
+	ClientKeyFile  string
+	// Name the SMTP-server's certificate is verified for and sent via SNI; Server if empty.
+	TLSServerName string
+	// Signs probing-mails via DKIM for DKIMDomain with the RSA-key in DKIMKeyFile published
+	// under DKIMSelector; mails are not signed if DKIMKeyFile is empty.
+	DKIMDomain   string
+	DKIMSelector string
+	DKIMKeyFile  string
 	// The directory in which mails sent by this server will end up if delivered correctly.
 	Detectiondir string
+	// Further directories mails sent by this server may end up in, e.g. both new/ and cur/ of a Maildir.
+	Detectiondirs []string
+	// Glob the names of files in the Detectiondirs must match to be considered; all files if empty.
+	FilenamePattern string
+	// Also watches all subdirectories of the Detectiondirs, including ones created at runtime.
+	WatchRecursive bool
+	// Objectives on the delivery durations evaluated over the last SLOWindow deliveries.
+	SLOs []sloConfig
+	// Overrides the global MonitoringInterval for this server if set.
+	Interval time.Duration
+	// Overrides the global MailCheckTimeout for this server if set.
+	MailCheckTimeout time.Duration
+	// Mails delivered in time but taking longer than this are counted as slow; disabled if 0.
+	WarnDuration time.Duration
+}
+
+// interval returns the time to wait between probes of this server.
+func (c smtpServerConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return globalconf.MonitoringInterval
+}
+
+// timeout returns the time to wait for probing-mails of this server.
+func (c smtpServerConfig) timeout() time.Duration {
+	if c.MailCheckTimeout > 0 {
+		return c.MailCheckTimeout
+	}
+	return globalconf.MailCheckTimeout
+}
+
+// socketPath returns the path of the Unix domain socket the SMTP-server is reached via,
+// empty if it is reached via TCP.
+func (c smtpServerConfig) socketPath() string {
+	if !strings.HasPrefix(c.Server, "unix://") {
+		return ""
+	}
+	return strings.TrimPrefix(c.Server, "unix://")
+}
+
+// hostName returns the name of the SMTP-server to verify its certificate and authenticate against,
+// localhost for Unix domain sockets, which are as trustworthy as connections to the loopback.
+func (c smtpServerConfig) hostName() string {
+	if c.socketPath() != "" {
+		return "localhost"
+	}
+	return c.Server
+}
+
+// messageIDDomain returns the domain to compose the Message-IDs of this server's probing-mails with,
+// empty if the sender's domain is to be used.
+func (c smtpServerConfig) messageIDDomain() string {
+	if c.MessageIDDomain != "" {
+		return c.MessageIDDomain
+	}
+	return globalconf.MessageIDDomain
+}
+
+// detectionDirs returns all directories mails sent by the server of config c may end up in.
+func (c smtpServerConfig) detectionDirs() []string {
+	if c.Detectiondir == "" {
+		return c.Detectiondirs
+	}
+	return append([]string{c.Detectiondir}, c.Detectiondirs...)
+}
+
+// timeoutOf returns the time waited for probing-mails of the named config, the
+// global MailCheckTimeout if there is no such config.
+func timeoutOf(name string) time.Duration {
+	for _, c := range globalconf.Servers {
+		if c.Name == name {
+			return c.timeout()
+		}
+	}
+	return globalconf.MailCheckTimeout
+}
+
+// maxTimeout returns the longest time any server waits for its probing-mails.
+func maxTimeout() time.Duration {
+	max := globalconf.MailCheckTimeout
+	for _, c := range globalconf.Servers {
+		if c.timeout() > max {
+			max = c.timeout()
+		}
+	}
+	return max
+}
+
+// addressList holds mail addresses, given in YAML either as a single string or as a list.
+type addressList []string
+
+func (l *addressList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*l = addressList{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := unmarshal(&multiple); err != nil {
+		return err
+	}
+	*l = multiple
+	return nil
 }
 
 var (
 	// cli-flags
 	version          = flag.Bool("version", false, "Print version information")
-	confPath         = flag.String("config.file", "/etc/mailexporter.conf", "Mailexporter configuration file to use.")
+	confPath         = flag.String("config.file", "/etc/mailexporter.conf", "Mailexporter configuration file to use, or a directory whose *.conf-files are merged.")
+	checkConfig      = flag.Bool("config.check", false, "Validate the configuration file and connectivity to all SMTP-servers, then exit.")
+	generateConfig   = flag.Bool("config.generate", false, "Print a commented example configuration with all settings, then exit.")
 	logTimestamps    = flag.Bool("log.timestamps", false, "Enable timestamps for logging to stdout.")
+	logFormat        = flag.String("log.format", "text", "Format of log messages, one of text or json.")
+	logLevelName     = flag.String("log.level", "", "Only log messages with the given severity or above, one of debug, info, warn or error; overrides -v and the config file.")
 	webListenAddress = flag.String("web.listen-address", ":9225", "Colon separated address and port to listen on for the telemetry.")
 	httpEndpoint     = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
 	verbosity        = flag.Int("v", 1, "verbosity; higher means more output")
 
 	// errors
-	errNotOurDept = errors.New("no mail of ours")
+	errNotOurDept     = errors.New("no mail of ours")
+	errDeliverTimeout = errors.New("probing-mail not delivered in time")
 
 	// listen-address
 )
@@ -158,14 +667,27 @@ type durationMetric struct {
 	hist  *prometheus.HistogramVec
 }
 
-func (m durationMetric) process(configname string, value float64) {
+// process records value for configname, linking the observation to the probe via
+// an exemplar carrying token, so slow buckets can be traced to the logs of the probe.
+func (m durationMetric) process(configname string, value float64, token string) {
 	m.gauge.WithLabelValues(configname).Set(value)
-	m.hist.WithLabelValues(configname).Observe(value)
+	obs := m.hist.WithLabelValues(configname)
+	if e, ok := obs.(prometheus.ExemplarObserver); ok {
+		e.ObserveWithExemplar(value, prometheus.Labels{"token": token})
+	} else {
+		obs.Observe(value)
+	}
+}
+
+// init creates the series for configname, with the gauge set to NaN as nothing was measured yet.
+func (m durationMetric) init(configname string) {
+	m.gauge.WithLabelValues(configname).Set(math.NaN())
+	m.hist.WithLabelValues(configname)
 }
 
-func (m durationMetric) register() {
-	prometheus.MustRegister(m.gauge)
-	prometheus.MustRegister(m.hist)
+func (m durationMetric) register(r prometheus.Registerer) {
+	r.MustRegister(m.gauge)
+	r.MustRegister(m.hist)
 }
 
 var deliverOk = prometheus.NewGaugeVec(
@@ -184,6 +706,38 @@ var lastMailDeliverTime = prometheus.NewGaugeVec(
 	[]string{"configname"},
 )
 
+var senderDeliverOk = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mail_sender_deliver_success",
+		Help: "indicator whether the last mail sent from the given sender-address was delivered in time",
+	},
+	[]string{"configname", "from"},
+)
+
+var clockSkewEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_clock_skew_events_total",
+		Help: "number of probing-mails received before they were sent according to their timestamps",
+	},
+	[]string{"configname"},
+)
+
+var mailsInFlight = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mail_in_flight",
+		Help: "number of probing-mails sent and still waited for",
+	},
+	[]string{"configname"},
+)
+
+var reportsDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_reports_dropped_total",
+		Help: "number of detected probing-mails dropped because their probe didn't accept them",
+	},
+	[]string{"configname"},
+)
+
 var lateMails = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "mail_late_mails_total",
@@ -192,6 +746,30 @@ var lateMails = prometheus.NewCounterVec(
 	[]string{"configname"},
 )
 
+var earlyMails = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_early_mails_total",
+		Help: "number of probing-mails received no probe waits for before their respective timeout",
+	},
+	[]string{"configname"},
+)
+
+var slowMails = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_deliver_slow_total",
+		Help: "number of probing-mails delivered in time but slower than the server's warnduration",
+	},
+	[]string{"configname"},
+)
+
+var tokenGenerationFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_token_generation_failures_total",
+		Help: "number of probes not sent because no random token could be generated",
+	},
+	[]string{"configname"},
+)
+
 var mailSendFails = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "mail_send_fails_total",
@@ -200,6 +778,131 @@ var mailSendFails = prometheus.NewCounterVec(
 	[]string{"configname"},
 )
 
+var probesSkippedRateLimited = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_probe_skipped_ratelimited_total",
+		Help: "number of probing mails not sent because the server's maxsendsperminute was exceeded",
+	},
+	[]string{"configname"},
+)
+
+var mailSendErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_send_errors_total",
+		Help: "number of failed attempts to send a probing mail via specified SMTP-server by reason",
+	},
+	[]string{"configname", "reason"},
+)
+
+var exporterUp = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "mailexporter_up",
+		Help: "indicator whether mailexporter's internal subsystems such as mail-detection are running",
+	},
+)
+
+var serversConfigured = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "mailexporter_servers_configured",
+		Help: "number of servers in the configuration, including disabled ones",
+	},
+)
+
+var serversActive = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "mailexporter_servers_active",
+		Help: "number of servers currently being monitored",
+	},
+)
+
+var buildInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mailexporter_build_info",
+		Help: "constant 1, labeled with the version, revision and Go-version mailexporter was built with",
+	},
+	[]string{"version", "revision", "goversion"},
+)
+
+var probesStarted = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_probe_started_total",
+		Help: "number of probes started, regardless of their outcome",
+	},
+	[]string{"configname"},
+)
+
+var probesSucceeded = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_probe_success_total",
+		Help: "number of probes whose probing-mails were all delivered in time",
+	},
+	[]string{"configname"},
+)
+
+var probesTimedOut = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_probe_timeout_total",
+		Help: "number of probes whose probing-mails were not all delivered in time",
+	},
+	[]string{"configname"},
+)
+
+var monitorPanics = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_monitor_panics_total",
+		Help: "number of probes aborted by a panic, after which monitoring continues",
+	},
+	[]string{"configname"},
+)
+
+var lastProbeTime = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mail_last_probe_timestamp",
+		Help: "unix-timestamp of the start of the last probe",
+	},
+	[]string{"configname"},
+)
+
+var detectionWatchUp = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mail_detection_watch_up",
+		Help: "indicator whether all Detectiondirs are being watched for incoming mails",
+	},
+	[]string{"configname"},
+)
+
+var configTimeout = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mail_config_timeout_seconds",
+		Help: "configured time to wait for probing-mails to arrive",
+	},
+	[]string{"configname"},
+)
+
+var configInterval = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mail_config_interval_seconds",
+		Help: "configured time between two probes",
+	},
+	[]string{"configname"},
+)
+
+var staleMailsSwept = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mail_stale_swept_total",
+		Help: "number of probing-mails deleted for being too old to ever be matched",
+	},
+	[]string{"configname"},
+)
+
+var mailMaintenance = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mail_maintenance",
+		Help: "indicator whether the probed mail setup is currently in maintenance",
+	},
+	[]string{"configname"},
+)
+
 var (
 	// mail_deliver_durations is linearly bucketed for low roundtrip-times and exponential for higher ones, to
 	// inexpensively catch really all late-comers. Therefore we first build the linear part of the buckets and
@@ -225,6 +928,16 @@ var (
 		[]string{"configname"},
 	)
 
+	// late mails are bucketed the same way to compare them with the timeout
+	lateMailAge = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mail_late_mail_age_seconds",
+			Help:    "durations of delivery of probing-mails received after their respective timeout",
+			Buckets: append(delDurLinBuckets, delDurExpBuckets...),
+		},
+		[]string{"configname"},
+	)
+
 	deliverDurationGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "mail_last_deliver_duration_seconds",
@@ -267,139 +980,1389 @@ var (
 	)
 
 	mailSendDuration = durationMetric{sendDurationGauge, sendDurationHist}
+
+	// connecting is part of the handover, so it is bucketed the same way
+	connectDurationHist = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mail_connect_durations_seconds",
+			Help:    "durations of establishing the connection to external SMTP-servers up to completed authentication",
+			Buckets: append(sendDurLinBuckets, sendDurExpBuckets...),
+		},
+		[]string{"configname"},
+	)
+)
+
+// detectionDuration covers parsing and handing over a detected mail, which
+// should take milliseconds rather than the seconds delivery is bucketed for.
+var detectionDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mail_detection_processing_duration_seconds",
+		Help:    "durations from starting to parse a detected mail until handing it over to its probe",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	},
+	[]string{"configname"},
 )
 
-func init() {
-	prometheus.MustRegister(deliverOk)
-	prometheus.MustRegister(lastMailDeliverTime)
-	prometheus.MustRegister(lateMails)
-	prometheus.MustRegister(mailSendFails)
-	mailDeliverDuration.register()
-	mailSendDuration.register()
+// registry holds all metrics served on the metrics endpoint, explicitly including the
+// Go runtime and process metrics instead of relying on the defaults of client_golang.
+var registry = prometheus.NewRegistry()
+
+// newMetricsHandler returns the handler serving the metrics registered with r.
+// Exemplars are only exposed in the OpenMetrics-format; responses are gzipped
+// for scrapers accepting it, which saves a lot on the bulky histograms.
+func newMetricsHandler(r *prometheus.Registry) http.Handler {
+	return promhttp.InstrumentMetricHandler(r,
+		promhttp.HandlerFor(r, promhttp.HandlerOpts{EnableOpenMetrics: true, DisableCompression: false}))
+}
 
+// registerMetrics registers all metrics of the exporter with r.
+func registerMetrics(r prometheus.Registerer) {
+	r.MustRegister(prometheus.NewGoCollector())
+	r.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	r.MustRegister(deliverOk)
+	r.MustRegister(lastMailDeliverTime)
+	r.MustRegister(lateMails)
+	r.MustRegister(slowMails)
+	r.MustRegister(lateMailAge)
+	r.MustRegister(earlyMails)
+	r.MustRegister(reportsDropped)
+	r.MustRegister(mailsInFlight)
+	r.MustRegister(clockSkewEvents)
+	r.MustRegister(senderDeliverOk)
+	r.MustRegister(mailSendFails)
+	r.MustRegister(tokenGenerationFailures)
+	r.MustRegister(mailSendErrors)
+	r.MustRegister(probesSkippedRateLimited)
+	r.MustRegister(mailMaintenance)
+	r.MustRegister(staleMailsSwept)
+	r.MustRegister(probesStarted)
+	r.MustRegister(probesSucceeded)
+	r.MustRegister(probesTimedOut)
+	r.MustRegister(monitorPanics)
+	r.MustRegister(lastProbeTime)
+	r.MustRegister(configTimeout)
+	r.MustRegister(configInterval)
+	r.MustRegister(buildInfo)
+	r.MustRegister(exporterUp)
+	r.MustRegister(serversConfigured)
+	r.MustRegister(serversActive)
+	r.MustRegister(detectionWatchUp)
+	r.MustRegister(detectionDuration)
+	buildInfo.WithLabelValues(buildVersion, buildRevision, runtime.Version()).Set(1)
+	r.MustRegister(sloViolation)
+	r.MustRegister(lastError)
+	r.MustRegister(sinceLastDeliveryCollector)
+	mailDeliverDuration.register(r)
+	mailSendDuration.register(r)
+	r.MustRegister(connectDurationHist)
 }
 
-// parseConfig parses configuration file and tells us if we are ready to rumble.
-func parseConfig(r io.Reader) error {
-	content, err := ioutil.ReadAll(r)
+// validateAddress checks that addr is a bare mail address as used in the SMTP-envelope,
+// i.e. without display name or angle brackets.
+func validateAddress(addr string) error {
+	parsed, err := mail.ParseAddress(addr)
 	if err != nil {
+		return fmt.Errorf("invalid address %q: %s", addr, err)
+	}
+	if parsed.Address != addr {
+		return fmt.Errorf("invalid address %q: must be given as %s only", addr, parsed.Address)
+	}
+	return nil
+}
+
+// validateDomain checks that domain is a plausible fully qualified domain name
+// to be used as the right-hand side of Message-IDs.
+func validateDomain(domain string) error {
+	labels := strings.Split(domain, ".")
+	if len(domain) > 253 || len(labels) < 2 {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid domain %q", domain)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("invalid domain %q", domain)
+			}
+		}
+	}
+	return nil
+}
+
+// composedHeaders are the headers set by send itself, which must not be given in Headers.
+var composedHeaders = []string{"From", "To", "Subject", "MIME-Version", "Content-Type", "Message-Id", "Date", payloadHeader}
+
+// validateHeader checks that name is a valid header field name not composed by send
+// and that value fits on a single line.
+func validateHeader(name string, value string) error {
+	if name == "" {
+		return errors.New("empty header name")
+	}
+	for _, r := range name {
+		// RFC 5322: printable US-ASCII except colon
+		if r < 33 || r > 126 || r == ':' {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	for _, composed := range composedHeaders {
+		if strings.EqualFold(name, composed) {
+			return fmt.Errorf("header %s is set by mailexporter itself", name)
+		}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("value of header %s must not contain line breaks", name)
+	}
+	return nil
+}
+
+// enabledServers returns the servers of servers which are not disabled.
+func enabledServers(servers []smtpServerConfig) []smtpServerConfig {
+	var enabled []smtpServerConfig
+	for _, c := range servers {
+		if c.Enabled != nil && !*c.Enabled {
+			slog.Info("server disabled, ignoring it", "config", c.Name)
+			continue
+		}
+		enabled = append(enabled, c)
+	}
+	return enabled
+}
+
+// initMetrics creates all series of config c so that every configured server is exported
+// right from the start instead of only after its first probe or failure.
+func initMetrics(c smtpServerConfig) {
+	deliverOk.WithLabelValues(c.Name).Set(0)
+	for _, from := range c.From {
+		senderDeliverOk.WithLabelValues(c.Name, from).Set(0)
+	}
+	lastMailDeliverTime.WithLabelValues(c.Name)
+	lateMails.WithLabelValues(c.Name)
+	slowMails.WithLabelValues(c.Name)
+	lateMailAge.WithLabelValues(c.Name)
+	earlyMails.WithLabelValues(c.Name)
+	reportsDropped.WithLabelValues(c.Name)
+	mailsInFlight.WithLabelValues(c.Name)
+	clockSkewEvents.WithLabelValues(c.Name)
+	setLastError(c.Name, "")
+	detectionDuration.WithLabelValues(c.Name)
+	mailSendFails.WithLabelValues(c.Name)
+	tokenGenerationFailures.WithLabelValues(c.Name)
+	for _, reason := range sendErrorReasons {
+		mailSendErrors.WithLabelValues(c.Name, reason)
+	}
+	probesSkippedRateLimited.WithLabelValues(c.Name)
+	mailMaintenance.WithLabelValues(c.Name)
+	staleMailsSwept.WithLabelValues(c.Name)
+	probesStarted.WithLabelValues(c.Name)
+	probesSucceeded.WithLabelValues(c.Name)
+	probesTimedOut.WithLabelValues(c.Name)
+	monitorPanics.WithLabelValues(c.Name)
+	lastProbeTime.WithLabelValues(c.Name)
+	mailDeliverDuration.init(c.Name)
+	mailSendDuration.init(c.Name)
+	connectDurationHist.WithLabelValues(c.Name)
+
+	for _, slo := range c.SLOs {
+		sloViolation.WithLabelValues(c.Name, slo.String())
+	}
+
+	configTimeout.WithLabelValues(c.Name).Set(c.timeout().Seconds())
+	configInterval.WithLabelValues(c.Name).Set(c.interval().Seconds())
+}
+
+// parseConfig parses the configuration files in order and tells us if we are ready to rumble.
+func parseConfig(paths []string) error {
+	for _, path := range paths {
+		if err := mergeConfigFile(path); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	serversConfigured.Set(float64(len(globalconf.Servers)))
+	globalconf.Servers = enabledServers(globalconf.Servers)
+
+	return validateConfig()
+}
+
+// mergeConfigFile reads the config file at path into globalconf. Settings given override
+// those of files read before, while servers are appended to the ones read before.
+func mergeConfigFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fileClose(f)
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	servers := globalconf.Servers
+	globalconf.Servers = nil
+	// strict, so misspelled or obsolete keys are reported instead of silently ignored
+	err = yaml.UnmarshalStrict(content, &globalconf)
+	globalconf.Servers = append(servers, globalconf.Servers...)
+	return err
+}
+
+// configFiles returns the config files to read for path: path itself if it is a file,
+// or all *.conf-files within it in lexical order if it is a directory.
+func configFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+
+	// Glob returns its matches sorted
+	files, err := filepath.Glob(filepath.Join(path, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.conf-files in %s", path)
+	}
+	return files, nil
+}
+
+// validateConfig checks the parsed configuration for values we cannot work with.
+func validateConfig() error {
+	if globalconf.LogLevel != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(globalconf.LogLevel)); err != nil {
+			return fmt.Errorf("loglevel: %s", err)
+		}
+	}
+
+	if globalconf.DuplicateWindow == 0 {
+		// the global MailCheckTimeout may be unset if all servers have their own
+		globalconf.DuplicateWindow = maxTimeout()
+	}
+
+	names := make(map[string]bool)
+	for _, c := range globalconf.Servers {
+		// metrics, maintenance and token-routing all go by name
+		if names[c.Name] {
+			return fmt.Errorf("server %s: name is used more than once", c.Name)
+		}
+		names[c.Name] = true
+
+		if len(c.To) == 0 {
+			return fmt.Errorf("server %s: no recipient given in to", c.Name)
+		}
+
+		if len(c.From) == 0 {
+			return fmt.Errorf("server %s: no sender given in from", c.Name)
+		}
+		for _, from := range c.From {
+			if err := validateAddress(from); err != nil {
+				return fmt.Errorf("server %s: from: %s", c.Name, err)
+			}
+		}
+		if c.FromName != "" {
+			if _, err := mail.ParseAddress(fromHeader(c.FromName, c.From[0])); err != nil {
+				return fmt.Errorf("server %s: fromname: %s", c.Name, err)
+			}
+		}
+		for _, to := range c.To {
+			if err := validateAddress(to); err != nil {
+				return fmt.Errorf("server %s: to: %s", c.Name, err)
+			}
+		}
+
+		if len(c.detectionDirs()) == 0 {
+			return fmt.Errorf("server %s: no directory given in detectiondir or detectiondirs", c.Name)
+		}
+		if _, err := filepath.Match(c.FilenamePattern, ""); err != nil {
+			return fmt.Errorf("server %s: filenamepattern: %s", c.Name, err)
+		}
+
+		if c.Interval < 0 {
+			return fmt.Errorf("server %s: interval must be positive", c.Name)
+		}
+		if c.MailCheckTimeout < 0 {
+			return fmt.Errorf("server %s: mailchecktimeout must be positive", c.Name)
+		}
+		if c.interval() <= 0 {
+			return fmt.Errorf("server %s: no positive monitoringinterval given, neither globally nor as interval of the server", c.Name)
+		}
+		if c.timeout() <= 0 {
+			return fmt.Errorf("server %s: no positive mailchecktimeout given, neither globally nor for the server", c.Name)
+		}
+		if c.WarnDuration < 0 {
+			return fmt.Errorf("server %s: warnduration must be positive", c.Name)
+		}
+
+		for name, value := range c.Headers {
+			if err := validateHeader(name, value); err != nil {
+				return fmt.Errorf("server %s: headers: %s", c.Name, err)
+			}
+		}
+
+		if c.MaxSendsPerMinute < 0 {
+			return fmt.Errorf("server %s: maxsendsperminute must not be negative", c.Name)
+		}
+		if c.PayloadPadding < 0 {
+			return fmt.Errorf("server %s: payloadpadding must not be negative", c.Name)
+		}
+
+		if c.SourceAddress != "" && net.ParseIP(c.SourceAddress) == nil {
+			return fmt.Errorf("server %s: sourceaddress: invalid IP-address %q", c.Name, c.SourceAddress)
+		}
+
+		if c.MessageIDDomain != "" {
+			if err := validateDomain(c.MessageIDDomain); err != nil {
+				return fmt.Errorf("server %s: messageiddomain: %s", c.Name, err)
+			}
+		}
+
+		if c.socketPath() != "" && (c.TunnelVia != "" || c.Proxy != "" || c.SourceAddress != "" || c.Network != "") {
+			return fmt.Errorf("server %s: unix domain sockets cannot be combined with tunnelvia, proxy, sourceaddress or network", c.Name)
+		}
+		switch c.Network {
+		case "", "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("server %s: network must be tcp, tcp4 or tcp6, got %q", c.Name, c.Network)
+		}
+
+		if c.TunnelVia != "" {
+			if _, _, err := net.SplitHostPort(c.TunnelVia); err != nil {
+				return fmt.Errorf("server %s: tunnelvia: %s", c.Name, err)
+			}
+		}
+
+		if c.CAFile != "" {
+			pool, err := loadCAFile(c.CAFile)
+			if err != nil {
+				return fmt.Errorf("server %s: cafile: %s", c.Name, err)
+			}
+			smtpRootCAs[c.Name] = pool
+		}
+
+		if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+			return fmt.Errorf("server %s: clientcertfile and clientkeyfile must be given together", c.Name)
+		}
+		if c.ClientCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+			if err != nil {
+				return fmt.Errorf("server %s: clientcertfile: %s", c.Name, err)
+			}
+			smtpClientCerts[c.Name] = cert
+		}
+
+		if c.DKIMKeyFile != "" {
+			if c.DKIMDomain == "" || c.DKIMSelector == "" {
+				return fmt.Errorf("server %s: dkimkeyfile requires dkimdomain and dkimselector", c.Name)
+			}
+			key, err := loadDKIMKey(c.DKIMKeyFile)
+			if err != nil {
+				return fmt.Errorf("server %s: dkimkeyfile: %s", c.Name, err)
+			}
+			dkimSigners[c.Name] = key
+		}
+
+		switch c.AuthMechanism {
+		case "", "plain":
+		case "xoauth2":
+			if c.Login == "" {
+				return fmt.Errorf("server %s: xoauth2 requires login", c.Name)
+			}
+			if c.OAuthToken == "" && (c.OAuthTokenURL == "" || c.OAuthClientID == "") {
+				return fmt.Errorf("server %s: xoauth2 requires oauthtoken or oauthtokenurl and oauthclientid", c.Name)
+			}
+		default:
+			return fmt.Errorf("server %s: authmechanism must be plain or xoauth2, got %q", c.Name, c.AuthMechanism)
+		}
+
+		if p := c.proxy(); p != "" {
+			if _, err := proxyDialer(p, &net.Dialer{}); err != nil {
+				return fmt.Errorf("server %s: proxy: %s", c.Name, err)
+			}
+		}
+	}
+
+	switch globalconf.PayloadFormat {
+	case "":
+		globalconf.PayloadFormat = "delimited"
+	case "delimited", "json":
+	default:
+		return fmt.Errorf("payloadformat must be delimited or json, got %q", globalconf.PayloadFormat)
+	}
+
+	if globalconf.Subject == "" {
+		globalconf.Subject = "mailexporter-probe"
+	}
+	tmpl, err := template.New("subject").Parse(globalconf.Subject)
+	if err != nil {
+		return fmt.Errorf("subject: %s", err)
+	}
+	subjectTemplate = tmpl
+	// render once to catch references to unknown fields right away
+	if _, err := renderSubject(smtpServerConfig{Name: "name"}, payload{token: "token"}); err != nil {
+		return fmt.Errorf("subject: %s", err)
+	}
+
+	if globalconf.MessageIDDomain != "" {
+		if err := validateDomain(globalconf.MessageIDDomain); err != nil {
+			return fmt.Errorf("messageiddomain: %s", err)
+		}
+	}
+
+	if globalconf.PayloadSeparator == "" {
+		globalconf.PayloadSeparator = "-"
+	}
+	if strings.Trim(globalconf.PayloadSeparator, separatorChars) != "" {
+		// tokens, timestamps, versions and MACs must never contain the separator,
+		// and payloads must fit on one line for headers and line-wise detection
+		return fmt.Errorf("payloadseparator may only consist of %s, got %q", separatorChars, globalconf.PayloadSeparator)
+	}
+
+	if globalconf.MaxMailReadBytes == 0 {
+		globalconf.MaxMailReadBytes = 64 * 1024
+	} else if globalconf.MaxMailReadBytes < 0 {
+		return errors.New("maxmailreadbytes must be positive")
+	}
+
+	if globalconf.MaxMailFileBytes == 0 {
+		globalconf.MaxMailFileBytes = 32 * 1024 * 1024
+	} else if globalconf.MaxMailFileBytes < 0 {
+		return errors.New("maxmailfilebytes must be positive")
+	}
+	for _, c := range globalconf.Servers {
+		// our own probing-mails must never be skipped
+		if int64(c.PayloadPadding) >= globalconf.MaxMailFileBytes {
+			return fmt.Errorf("server %s: payloadpadding must be below maxmailfilebytes", c.Name)
+		}
+	}
+
+	if globalconf.ArchiveDir != "" {
+		if fi, err := os.Stat(globalconf.ArchiveDir); err != nil {
+			return fmt.Errorf("archivedir: %s", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("archivedir: %s is no directory", globalconf.ArchiveDir)
+		}
+	}
+
+	if globalconf.SendRetries < 0 {
+		return errors.New("sendretries must not be negative")
+	}
+	if globalconf.SendRetryBackoff == 0 {
+		globalconf.SendRetryBackoff = time.Second
+	} else if globalconf.SendRetryBackoff < 0 {
+		return errors.New("sendretrybackoff must be positive")
+	}
+
+	if globalconf.SendTimeout < 0 {
+		return errors.New("sendtimeout must not be negative")
+	}
+
+	if globalconf.MaxConcurrentProbes < 0 {
+		return errors.New("maxconcurrentprobes must not be negative")
+	}
+
+	if globalconf.StartupOffset != nil && *globalconf.StartupOffset < 0 {
+		return errors.New("startupoffset must not be negative")
+	}
+
+	if globalconf.IntervalJitter < 0 || globalconf.IntervalJitter >= 1 {
+		return fmt.Errorf("intervaljitter must be in [0, 1), got %g", globalconf.IntervalJitter)
+	}
+
+	if globalconf.ParseWorkers == 0 {
+		globalconf.ParseWorkers = runtime.NumCPU()
+	} else if globalconf.ParseWorkers < 0 {
+		return errors.New("parseworkers must be positive")
+	}
+
+	if globalconf.StaleMailFactor < 0 {
+		return errors.New("stalemailfactor must not be negative")
+	}
+
+	if globalconf.SLOWindow == 0 {
+		globalconf.SLOWindow = 100
+	} else if globalconf.SLOWindow < 0 {
+		return errors.New("slowindow must be positive")
+	}
+
+	for _, c := range globalconf.Servers {
+		for _, slo := range c.SLOs {
+			if slo.Percentile <= 0 || slo.Percentile > 100 {
+				return fmt.Errorf("server %s: slo percentile must be in (0, 100], got %g", c.Name, slo.Percentile)
+			}
+			if slo.Threshold <= 0 {
+				return fmt.Errorf("server %s: slo threshold must be positive", c.Name)
+			}
+		}
+	}
+
+	if globalconf.HtpasswdFile != "" {
+		// the htpasswd-provider panics on unreadable or malformed files, so catch that early
+		if err := checkHtpasswd(globalconf.HtpasswdFile); err != nil {
+			return fmt.Errorf("htpasswdfile: %s", err)
+		}
+	}
+
+	if globalconf.AuthPassHash != "" {
+		if _, err := bcrypt.Cost([]byte(globalconf.AuthPassHash)); err != nil {
+			return fmt.Errorf("authpasshash: not a valid bcrypt-hash: %s", err)
+		}
+		authPassHash = globalconf.AuthPassHash
+	} else if globalconf.AuthPass != "" {
+		// hash once on startup with a fresh salt to not keep comparing against plaintext
+		hash, err := bcrypt.GenerateFromPassword([]byte(globalconf.AuthPass), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		authPassHash = string(hash)
+	}
+
+	if globalconf.AuthUser != "" && authPassHash == "" {
+		return errors.New("authuser given without authpass or authpasshash")
+	}
+
+	if globalconf.Pushgateway != nil {
+		if err := globalconf.Pushgateway.validate(); err != nil {
+			return fmt.Errorf("pushgateway: %s", err)
+		}
+	}
+
+	if globalconf.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(globalconf.ListenAddress); err != nil {
+			return fmt.Errorf("listenaddress: %s", err)
+		}
+	}
+
+	if (globalconf.CrtPath == "") != (globalconf.KeyPath == "") {
+		return errors.New("crtpath and keypath must be given together")
+	}
+	if globalconf.GenerateSelfSignedCert && globalconf.CrtPath != "" {
+		return errors.New("generateselfsignedcert must not be combined with crtpath and keypath")
+	}
+
+	if globalconf.TLSMinVersion == "" {
+		globalconf.TLSMinVersion = "1.2"
+	}
+	if _, err := tlsVersion(globalconf.TLSMinVersion); err != nil {
+		return err
+	}
+
+	if _, err := cipherSuites(globalconf.CipherSuites); err != nil {
+		return err
+	}
+
+	if globalconf.ClientCAPath != "" && !tlsEnabled() {
+		return errors.New("clientcapath requires crtpath and keypath or generateselfsignedcert to be set")
+	}
+
+	return nil
+}
+
+// paddingLineLength is the length of the lines of padding, well below the 998 chars allowed by RFC 5322.
+const paddingLineLength = 76
+
+// padding returns n bytes of filler lines to follow the payload in the body of a probing-mail,
+// one more if the last line would be cut within its line break. The payload is on a line of
+// its own before it, so it is found first and within MaxMailReadBytes.
+func padding(n int) string {
+	if n <= 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.Grow(n + 1)
+	for b.Len() < n {
+		line := "\r\n" + strings.Repeat("x", paddingLineLength)
+		if rest := n - b.Len(); rest < len(line) {
+			// never split the line break
+			line = line[:max(rest, 2)]
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// subjectTemplate is parsed from Subject on startup.
+var subjectTemplate *template.Template
+
+// subjectData is what Subject is rendered with.
+type subjectData struct {
+	Name  string
+	Token string
+}
+
+// renderSubject renders the subject of the probing-mail carrying p sent via config c.
+func renderSubject(c smtpServerConfig, p payload) (string, error) {
+	var b strings.Builder
+	if err := subjectTemplate.Execute(&b, subjectData{c.Name, p.token}); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(b.String(), "\r\n") {
+		return "", errors.New("subject must not contain line breaks")
+	}
+	return b.String(), nil
+}
+
+// fromHeader returns the From-header for sender with the display name name, the bare
+// address if name is empty. The envelope always uses the bare address.
+func fromHeader(name string, sender string) string {
+	if name == "" {
+		return sender
+	}
+	// quotes or encodes the name as needed
+	return (&mail.Address{Name: name, Address: sender}).String()
+}
+
+// createMsgId returns the Message-ID of the probing-mail p sent via config c from sender,
+// unique per probe as it contains its token. It is independent of the payload format,
+// which may contain characters not allowed in a Message-ID.
+func createMsgId(c smtpServerConfig, sender string, p payload) string {
+	id := p.token + "." + strconv.FormatInt(p.timestamp, 10)
+
+	if domain := c.messageIDDomain(); domain != "" {
+		return id + "@" + domain
+	}
+
+	addrParts := strings.Split(sender, "@")
+	if len(addrParts) > 1 {
+		return id + "@" + addrParts[1]
+	} else {
+		return id + "-" + sender
+	}
+}
+
+// send sends a probing-email from sender over SMTP-server specified in config c to
+// recipient to to be waited for on the receiving side.
+func send(ctx context.Context, c smtpServerConfig, sender string, to string, p payload) error {
+	slog.Debug("sending mail", "config", c.Name)
+	msg := p.String()
+
+	subject, err := renderSubject(c, p)
+	if err != nil {
+		return err
+	}
+
+	fullmail := "From: " + fromHeader(c.FromName, sender) + "\r\n"
+	fullmail += "To: " + to + "\r\n"
+	fullmail += "Subject: " + subject + "\r\n"
+	fullmail += "MIME-Version: 1.0" + "\r\n"
+	fullmail += "Content-Type: text/plain; charset=us-ascii" + "\r\n"
+	fullmail += "Message-Id: <" + createMsgId(c, sender, p) + ">\r\n"
+	if globalconf.PayloadHeader {
+		fullmail += payloadHeader + ": " + msg + "\r\n"
+	}
+	// sorted to compose the same mail for the same probe every time
+	names := make([]string, 0, len(c.Headers))
+	for name := range c.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fullmail += name + ": " + c.Headers[name] + "\r\n"
+	}
+
+	// RFC 5322 date-time, RFC3339 is not accepted there
+	fullmail += "Date: " + now().Format(time.RFC1123Z) + "\r\n"
+
+	fullmail += "\r\n" + msg + padding(c.PayloadPadding)
+
+	fullmail, err = dkimSign(c, fullmail)
+	if err != nil {
+		return err
+	}
+
+	if !takeSend(c) {
+		return errRateLimited
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = sendAttempt(ctx, c, sender, to, p.token, []byte(fullmail))
+		if err == nil || attempt >= globalconf.SendRetries || !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		backoff := globalconf.SendRetryBackoff << attempt
+		slog.Info("transient error sending probe-mail, retrying", "config", c.Name, "to", to, "err", err, "backoff", backoff)
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
+	}
+}
+
+// sendAttempt hands fullmail from sender over to the SMTP-server of config c once, recording the duration taken.
+func sendAttempt(ctx context.Context, c smtpServerConfig, sender string, to string, token string, fullmail []byte) error {
+	acquireProbeSlot()
+	defer releaseProbeSlot()
+
+	t1 := now()
+	err := deliver(ctx, c, sender, to, fullmail)
+	t2 := now()
+	diff := t2.Sub(t1)
+
+	sendDuration := float64(diff.Seconds())
+	mailSendDuration.process(c.Name, sendDuration, token)
+
+	if err == nil {
+		slog.Debug("mail handed over", "config", c.Name, "took", diff)
+	}
+	return err
+}
+
+// isTransient tells if a send failing with err may succeed when retried: temporary (4xx)
+// rejections and network trouble are, permanent (5xx) rejections, TLS- and auth-failures aren't.
+func isTransient(err error) bool {
+	switch classifySendError(err) {
+	case "4xx", "timeout", "connect":
+		return true
+	}
+	return false
+}
+
+// smtpAuth returns the authentication to use for the SMTP-server of config c, nil if none.
+func smtpAuth(c smtpServerConfig) smtp.Auth {
+	var a smtp.Auth
+	if c.AuthMechanism == "xoauth2" {
+		a = xoauth2Auth{c.Login, oauthTokens(c)}
+	} else {
+		if c.Login == "" && c.Passphrase == "" { // if login and passphrase are left empty, skip authentication
+			return nil
+		}
+		a = smtp.PlainAuth("", c.Login, c.Passphrase, c.hostName())
+	}
+
+	if c.TunnelVia != "" {
+		return tunnelAuth{a}
+	}
+	return a
+}
+
+// tunnelAuth marks the connection as encrypted for the wrapped Auth, as the tunnel
+// takes care of encrypting the traffic to the relay.
+type tunnelAuth struct {
+	smtp.Auth
+}
+
+func (a tunnelAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	server.TLS = true
+	return a.Auth.Start(server)
+}
+
+// cancelConn closes the wrapped connection once the context it is bound to is cancelled,
+// which aborts any SMTP-conversation currently blocked on it.
+type cancelConn struct {
+	net.Conn
+	mu   sync.Mutex
+	stop func() bool
+}
+
+func newCancelConn(ctx context.Context, conn net.Conn) *cancelConn {
+	c := &cancelConn{Conn: conn}
+	c.bind(ctx)
+	return c
+}
+
+// bind makes cancelling ctx close the connection instead of the context bound before,
+// so that a reused connection is aborted along with the conversation currently using it.
+func (c *cancelConn) bind(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stop != nil {
+		c.stop()
+	}
+	c.stop = context.AfterFunc(ctx, func() { c.Conn.Close() })
+}
+
+// unbind detaches the connection from the context bound before, so that it outlives
+// the conversation while idle. It reports false if the context closed it already.
+func (c *cancelConn) unbind() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	open := c.stop == nil || c.stop()
+	c.stop = nil
+	return open
+}
+
+func (c *cancelConn) Close() error {
+	c.unbind()
+	return c.Conn.Close()
+}
+
+// limitConversation makes the conversation on conn time out after SendTimeout from now, if configured.
+func limitConversation(conn net.Conn) {
+	if globalconf.SendTimeout > 0 {
+		// deadlines are real time, not the replaceable clock
+		conn.SetDeadline(time.Now().Add(globalconf.SendTimeout))
+	}
+}
+
+// smtpConn is a client of an SMTP-server together with its connection, so that the
+// connection can be bound to the context of each conversation when reused.
+type smtpConn struct {
+	*smtp.Client
+	conn *cancelConn
+}
+
+// dial connects to the SMTP-server of config c, or to its tunnel if configured.
+func dial(ctx context.Context, c smtpServerConfig) (smtpConn, error) {
+	network, addr := "tcp", net.JoinHostPort(c.Server, c.Port)
+	if c.Network != "" {
+		network = c.Network
+	}
+	if c.TunnelVia != "" {
+		addr = c.TunnelVia
+	}
+	if path := c.socketPath(); path != "" {
+		// tunnels and source addresses are ruled out on startup
+		network, addr = "unix", path
+	}
+
+	base := &net.Dialer{}
+	if c.SourceAddress != "" {
+		// validated on startup
+		base.LocalAddr = &net.TCPAddr{IP: net.ParseIP(c.SourceAddress)}
+	}
+
+	var d proxy.ContextDialer = base
+	if p := c.proxy(); p != "" && network != "unix" {
+		var err error
+		if d, err = proxyDialer(p, base); err != nil {
+			return smtpConn{}, err
+		}
+	}
+
+	raw, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return smtpConn{}, err
+	}
+	conn := newCancelConn(ctx, raw)
+	limitConversation(conn)
+
+	// the server name is always the relay itself, also when connecting via a tunnel
+	client, err := smtp.NewClient(conn, c.hostName())
+	if err != nil {
+		return smtpConn{}, err
+	}
+
+	if c.HelloName != "" {
+		if err := client.Hello(c.HelloName); err != nil {
+			client.Close()
+			return smtpConn{}, err
+		}
+	}
+
+	return smtpConn{client, conn}, nil
+}
+
+// smtpRootCAs holds the CAs of every config with CAFile, loaded on startup.
+var smtpRootCAs = make(map[string]*x509.CertPool)
+
+// smtpClientCerts holds the client certificate of every config with ClientCertFile, loaded on startup.
+var smtpClientCerts = make(map[string]tls.Certificate)
+
+// loadCAFile reads the PEM-encoded certificates at path into a pool.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, errors.New("no PEM-encoded certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns the TLS-configuration to verify the SMTP-server of config c with.
+func tlsConfig(c smtpServerConfig) *tls.Config {
+	name := c.hostName()
+	if c.TLSServerName != "" {
+		name = c.TLSServerName
+	}
+
+	config := &tls.Config{
+		ServerName:         name,
+		RootCAs:            smtpRootCAs[c.Name], // the system's CAs if nil
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if cert, ok := smtpClientCerts[c.Name]; ok {
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// connect dials the SMTP-server of config c, switches to TLS if possible and authenticates
+// if configured, leaving a client ready for sending.
+func connect(ctx context.Context, c smtpServerConfig) (smtpConn, error) {
+	client, err := dial(ctx, c)
+	if err != nil {
+		return smtpConn{}, stageError{"connect", err}
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(tlsConfig(c)); err != nil {
+			client.Close()
+			return smtpConn{}, stageError{"tls", err}
+		}
+	}
+
+	if a := smtpAuth(c); a != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			client.Close()
+			return smtpConn{}, stageError{"auth", errors.New("smtp: server doesn't support AUTH")}
+		}
+		if err = client.Auth(a); err != nil {
+			client.Close()
+			return smtpConn{}, stageError{"auth", err}
+		}
+	}
+
+	return client, nil
+}
+
+// deliver hands msg from sender for recipient to over to the SMTP-server of config c.
+// Cancelling ctx aborts the conversation and returns the context's error.
+func deliver(ctx context.Context, c smtpServerConfig, sender string, to string, msg []byte) error {
+	err := converse(ctx, c, sender, to, msg)
+	if ctx.Err() != nil {
+		// the conversation was aborted by closing the connection,
+		// report why instead of the resulting network error
+		return ctx.Err()
+	}
+	return err
+}
+
+// sendErrorReasons are all values of the reason label of mail_send_errors_total.
+var sendErrorReasons = []string{"connect", "tls", "auth", "timeout", "4xx", "5xx", "other"}
+
+// stageError marks an error as having happened while setting up the connection,
+// reason being the stage's label in mail_send_errors_total.
+type stageError struct {
+	reason string
+	err    error
+}
+
+func (e stageError) Error() string { return e.err.Error() }
+func (e stageError) Unwrap() error { return e.err }
+
+// classifySendError maps an error of send to one of sendErrorReasons,
+// keeping the reason label of mail_send_errors_total bounded.
+func classifySendError(err error) string {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return "timeout"
+	}
+
+	// a server replying while connecting, e.g. rejecting clients in its greeting, was
+	// reached, so its reply code tells whether retrying may help
+	var serr stageError
+	var terr *textproto.Error
+	if errors.As(err, &serr) && (serr.reason != "connect" || !errors.As(err, &terr)) {
+		return serr.reason
+	}
+
+	if errors.As(err, &terr) {
+		switch terr.Code / 100 {
+		case 4:
+			return "4xx"
+		case 5:
+			return "5xx"
+		}
+	}
+
+	return "other"
+}
+
+// converse runs the actual SMTP-conversation for deliver, recording the time taken
+// to connect separately from the handover as a whole. With ReuseConnection, the
+// connection of the previous conversation is used if still open and kept open afterwards.
+func converse(ctx context.Context, c smtpServerConfig, sender string, to string, msg []byte) error {
+	client, ok := takePooledConn(ctx, c)
+	if !ok {
+		t1 := now()
+		var err error
+		if client, err = connect(ctx, c); err != nil {
+			return err
+		}
+		connectDurationHist.WithLabelValues(c.Name).Observe(now().Sub(t1).Seconds())
+	}
+
+	if err := transfer(client, sender, to, msg); err != nil {
+		client.Close()
+		return err
+	}
+
+	if c.ReuseConnection {
+		putPooledConn(c, client)
+		return nil
+	}
+	defer client.Close()
+	return client.Quit()
+}
+
+// pooledConns holds the open connection of every config with ReuseConnection between probes.
+// Once drained on shutdown, no connections are kept anymore.
+var pooledConns = struct {
+	sync.Mutex
+	configs map[string]smtpConn
+	drained bool
+}{configs: make(map[string]smtpConn)}
+
+// takePooledConn takes the pooled connection of config c, bound to ctx, if there is one
+// and it is still usable.
+func takePooledConn(ctx context.Context, c smtpServerConfig) (smtpConn, bool) {
+	pooledConns.Lock()
+	client, ok := pooledConns.configs[c.Name]
+	delete(pooledConns.configs, c.Name)
+	pooledConns.Unlock()
+	if !ok {
+		return smtpConn{}, false
+	}
+
+	client.conn.bind(ctx)
+	limitConversation(client.conn)
+	// the server may have closed it meanwhile, e.g. after being idle for too long
+	if err := client.Reset(); err != nil {
+		slog.Debug("pooled connection unusable, reconnecting", "config", c.Name, "err", err)
+		client.Close()
+		return smtpConn{}, false
+	}
+	return client, true
+}
+
+// putPooledConn keeps client open for the next conversation of config c, closing the one
+// kept before if concurrent probes both opened one. The connection is detached from the
+// context of the conversation that used it, so that it stays open until taken again.
+func putPooledConn(c smtpServerConfig, client smtpConn) {
+	if !client.conn.unbind() {
+		// the conversation was cancelled right after completing
+		client.Close()
+		return
+	}
+
+	pooledConns.Lock()
+	defer pooledConns.Unlock()
+
+	if pooledConns.drained {
+		client.Quit()
+		return
+	}
+	if previous, ok := pooledConns.configs[c.Name]; ok {
+		previous.Quit()
+	}
+	pooledConns.configs[c.Name] = client
+}
+
+// drainPooledConns ends the conversations on all pooled connections on shutdown.
+func drainPooledConns() {
+	pooledConns.Lock()
+	defer pooledConns.Unlock()
+
+	for name, client := range pooledConns.configs {
+		limitConversation(client.conn)
+		if err := client.Quit(); err != nil {
+			slog.Debug("error closing pooled connection", "config", name, "err", err)
+			client.Close()
+		}
+		delete(pooledConns.configs, name)
+	}
+	pooledConns.drained = true
+}
+
+// transfer hands msg over from sender to recipient to via client.
+func transfer(client smtpConn, sender string, to string, msg []byte) error {
+	if err := client.Mail(sender); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
 		return err
 	}
+	return w.Close()
+}
+
+// tokenRand is the source of randomness for tokens, replaceable to simulate failures.
+var tokenRand io.Reader = crand.Reader
+
+// generateToken returns a random string to pad the send mail with for identifying
+// it later in the maildir (and not mistake another one for it)
+func generateToken(length int) (string, error) {
+	stuff := make([]byte, 0, length)
+
+	// bytes beyond the largest multiple of len(tokenChars) are skipped to not favor any chars
+	limit := 256 - 256%len(tokenChars)
+	buf := make([]byte, length)
+	for len(stuff) < length {
+		if _, err := io.ReadFull(tokenRand, buf); err != nil {
+			return "", fmt.Errorf("generating token: %s", err)
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(stuff) < length {
+				stuff = append(stuff, tokenChars[int(b)%len(tokenChars)])
+			}
+		}
+	}
 
-	return yaml.Unmarshal(content, &globalconf)
+	return string(stuff), nil
 }
 
-func createMsgId(c smtpServerConfig, msg string) string {
-	addrParts := strings.Split(c.From, "@")
-	if len(addrParts) > 1 {
-		return msg + "@" + addrParts[1]
+// deleteMail delete the given mail to not leave an untidied maildir,
+// or moves it to the ArchiveDir if configured.
+func deleteMailIfEnabled(m email) {
+	if globalconf.DisableFileDeletion {
+		slog.Debug("file deletion disabled in config, not touching", "file", m.filename)
+	} else if globalconf.ArchiveDir != "" {
+		archived := filepath.Join(globalconf.ArchiveDir, filepath.Base(m.filename))
+		if err := os.Rename(m.filename, archived); err != nil {
+			slog.Warn("archiving error", "err", err)
+		}
+		slog.Debug("mv", "file", m.filename, "to", archived)
 	} else {
-		return msg + "-" + c.From
+		if err := os.Remove(m.filename); err != nil {
+			slog.Warn("deletion error", "err", err)
+		}
+		slog.Debug("rm", "file", m.filename)
 	}
 }
 
-// send sends a probing-email over SMTP-server specified in config c to be waited for on the receiving side.
-func send(c smtpServerConfig, msg string) error {
-	logDebug.Println("sending mail")
-	fullmail := "From: " + c.From + "\r\n"
-	fullmail += "To: " + c.To + "\r\n"
-	fullmail += "Subject: mailexporter-probe" + "\r\n"
-	fullmail += "Content-Type: text/plain" + "\r\n"
-	fullmail += "Message-Id: <" + createMsgId(c, msg) + ">\r\n"
+// handleLateMail handles mails no probe waits for (anymore), telling late from early ones
+func handleLateMail(m email) {
+	if took := m.tRecv.Sub(m.tSent); took <= timeoutOf(m.configname) {
+		// can't be a leftover of a timed out probe, which would still wait for it, but arrived
+		// out of order instead, e.g. for a cancelled probe or from a clock running ahead
+		slog.Debug("got early mail", "config", m.configname, "took", took)
+		earlyMails.WithLabelValues(m.configname).Inc()
+	} else {
+		slog.Debug("got late mail", "config", m.configname, "took", m.tRecv.Sub(m.tSent))
+		lateMails.WithLabelValues(m.configname).Inc()
+		lateMailAge.WithLabelValues(m.configname).Observe(m.tRecv.Sub(m.tSent).Seconds())
+	}
+	deleteMailIfEnabled(m)
+}
 
-	fullmail += "Date: " + time.Now().Format(time.RFC3339) + "\r\n"
+// probeResult is the outcome of a single probe.
+type probeResult struct {
+	Name string `json:"name"`
+	// whether all probing-mails were delivered in time
+	Success bool `json:"success"`
+	// duration of the delivery of the last probing-mail in seconds if successful
+	DeliverDuration float64 `json:"deliver_duration_seconds"`
+	// why the probe failed if it did
+	Error string `json:"error,omitempty"`
+}
 
-	fullmail += "\r\n" + msg
+// probe probes if mail gets through the entire chain from specified SMTPServer into Maildir.
+// One probing-mail with its own payload is sent per recipient, all of their tokens being
+// reported on the same channel. Delivery only counts as successful if all of them arrive in time.
+func probe(ctx context.Context, c smtpServerConfig) probeResult {
+	sender := nextSender(c)
+	probesStarted.WithLabelValues(c.Name).Inc()
+	lastProbeTime.WithLabelValues(c.Name).Set(float64(now().Unix()))
+
+	// room for every token, so the detector never blocks on a probe that
+	// already timed out and is about to dispose its tokens
+	reports := make(chan email, len(c.To))
+	pending := make(map[string]payload, len(c.To))
+	inFlight := 0 // mails of pending successfully sent
+	defer func() {
+		for token := range pending {
+			releaseToken(token)
+		}
+		mailsInFlight.WithLabelValues(c.Name).Sub(float64(inFlight))
+	}()
+
+	for _, to := range c.To {
+		p, err := newPayload(c.Name)
+		if err != nil {
+			slog.Error("error composing payload; skipping attempt", "config", c.Name, "err", err)
+			tokenGenerationFailures.WithLabelValues(c.Name).Inc()
+			return probeResult{Name: c.Name, Error: err.Error()}
+		}
+		announceToken(registration{p.token, reports})
+		pending[p.token] = p
 
-	var a smtp.Auth
-	if c.Login == "" && c.Passphrase == "" { // if login and passphrase are left empty, skip authentication
-		a = nil
-	} else {
-		a = smtp.PlainAuth("", c.Login, c.Passphrase, c.Server)
+		err = send(ctx, c, sender, to, p)
+		if ctx.Err() != nil {
+			slog.Debug("probe cancelled", "config", c.Name)
+			return probeResult{Name: c.Name, Error: ctx.Err().Error()}
+		}
+		if errors.Is(err, errRateLimited) {
+			slog.Warn("maxsendsperminute exceeded; skipping attempt", "config", c.Name, "to", to)
+			probesSkippedRateLimited.WithLabelValues(c.Name).Inc()
+			return probeResult{Name: c.Name, Error: err.Error()}
+		}
+		if err != nil {
+			slog.Warn("error sending probe-mail; skipping attempt", "config", c.Name, "to", to, "err", err)
+			mailSendFails.WithLabelValues(c.Name).Inc()
+			reason := classifySendError(err)
+			mailSendErrors.WithLabelValues(c.Name, reason).Inc()
+			// undelivered just like a probe timing out, as reported on /status
+			deliverOk.WithLabelValues(c.Name).Set(0)
+			senderDeliverOk.WithLabelValues(c.Name, sender).Set(0)
+			recordError(c.Name, reason, err.Error())
+			return probeResult{Name: c.Name, Error: err.Error()}
+		}
+		inFlight++
+		mailsInFlight.WithLabelValues(c.Name).Inc()
 	}
-	
-	t1 := time.Now()
-	err := smtp.SendMail(c.Server+":"+c.Port, a, c.From, []string{c.To}, []byte(fullmail))
-	t2 := time.Now()
-	diff := t2.Sub(t1)
 
-	sendDuration := float64(diff.Seconds())
-	mailSendDuration.process(c.Name, sendDuration)
+	var last email
+	deadline := now().Add(c.timeout())
+	timeout := time.NewTimer(c.timeout())
+	defer timeout.Stop()
+	for len(pending) > 0 {
+		// select picks randomly among ready cases, so check the deadline explicitly
+		// to not miss it while reports keep coming in
+		if !now().Before(deadline) {
+			probeTimedOut(c, sender, pending)
+			return probeResult{Name: c.Name, Error: errDeliverTimeout.Error()}
+		}
 
-	return err
-}
+		select {
+		case mail := <-reports:
+			slog.Debug("mail delivered in time", "config", c.Name, "took", mail.tRecv.Sub(mail.tSent))
+			last = mail
+			if c.WarnDuration > 0 && mail.deliverDuration() > c.WarnDuration {
+				slog.Info("mail delivered slowly", "config", c.Name, "took", mail.deliverDuration(), "warnduration", c.WarnDuration)
+				slowMails.WithLabelValues(c.Name).Inc()
+			}
+			recordSLODuration(c.Name, mail.deliverDuration().Seconds())
 
-// generateToken returns a random string to pad the send mail with for identifying
-// it later in the maildir (and not mistake another one for it)
-func generateToken(length int) string {
-	stuff := make([]byte, length)
+			releaseToken(mail.token)
+			delete(pending, mail.token)
+			inFlight--
+			mailsInFlight.WithLabelValues(c.Name).Dec()
+			deleteMailIfEnabled(mail)
+
+		case <-timeout.C:
+			probeTimedOut(c, sender, pending)
+			return probeResult{Name: c.Name, Error: errDeliverTimeout.Error()}
 
-	rand.Seed(time.Now().UTC().UnixNano())
-	for i := 0; i < length; i++ {
-		stuff[i] = tokenChars[rand.Intn(len(tokenChars))]
+		case <-ctx.Done():
+			slog.Debug("probe cancelled", "config", c.Name)
+			return probeResult{Name: c.Name, Error: ctx.Err().Error()}
+		}
 	}
 
-	return string(stuff)
+	deliverOk.WithLabelValues(c.Name).Set(1)
+	senderDeliverOk.WithLabelValues(c.Name, sender).Set(1)
+	probesSucceeded.WithLabelValues(c.Name).Inc()
+	recordDelivery(c.Name, last.tRecv, last.deliverDuration())
+	return probeResult{Name: c.Name, Success: true, DeliverDuration: last.deliverDuration().Seconds()}
 }
 
-// deleteMail delete the given mail to not leave an untidied maildir.
-func deleteMailIfEnabled(m email) {
-	if globalconf.DisableFileDeletion {
-		logDebug.Println("file deletion disabled in config, not touching", m.filename)
-	} else {
-		if err := os.Remove(m.filename); err != nil {
-			logWarn.Println("deletion error:", err)
-		}
-		logDebug.Println("rm ", m.filename)
+// probeTimedOut records the failure of a probe of config c from sender whose pending mails didn't arrive in time.
+func probeTimedOut(c smtpServerConfig, sender string, pending map[string]payload) {
+	for _, p := range pending {
+		slog.Warn("Delivery-Timeout", "config", c.Name, "message-id", createMsgId(c, sender, p))
+		// a mail arriving late was already accounted for here, so
+		// late mails don't enter the SLO window a second time
+		recordSLOTimeout(c.Name)
 	}
+	deliverOk.WithLabelValues(c.Name).Set(0)
+	senderDeliverOk.WithLabelValues(c.Name, sender).Set(0)
+	probesTimedOut.WithLabelValues(c.Name).Inc()
+	recordTimeout(c.Name)
 }
 
-// handleLateMail handles mails that have been so late that they timed out
-func handleLateMail(m email) {
-	logDebug.Printf("got late mail via %s; mail took %d\n", m.configname, m.tRecv.Sub(m.tSent))
-	lateMails.WithLabelValues(m.configname).Inc()
-	deleteMailIfEnabled(m)
+// senderRotation holds the index of the next sender-address to use per config.
+var senderRotation = struct {
+	sync.Mutex
+	next map[string]int
+}{next: make(map[string]int)}
+
+// nextSender returns the address of From to send the next probe of config c from, round-robin.
+func nextSender(c smtpServerConfig) string {
+	senderRotation.Lock()
+	defer senderRotation.Unlock()
+
+	i := senderRotation.next[c.Name] % len(c.From)
+	senderRotation.next[c.Name] = i + 1
+	return c.From[i]
 }
 
-// probe probes if mail gets through the entire chain from specified SMTPServer into Maildir.
-func probe(c smtpServerConfig, p payload) {
-	muxer[p.token] = make(chan email)
+// monitor probes every MonitoringInterval (or the server's own Interval) if mail still gets through.
+// The first probe is delayed by index times StartupOffset to stagger servers. Monitors are
+// started in the background, so the offsets never delay anything but the probes.
+func monitor(ctx context.Context, c smtpServerConfig, index int) {
+	serversActive.Inc()
+	defer serversActive.Dec()
 
-	//send(c, string(p))
-	err := send(c, p.String())
-	if err != nil {
-		logWarn.Printf("error sending probe-mail via %s: %s; skipping attempt\n", c.Name, err)
-		mailSendFails.WithLabelValues(c.Name).Inc()
-		disposeToken <- p.token
+	var offset time.Duration
+	if globalconf.StartupOffset != nil {
+		offset = time.Duration(index) * *globalconf.StartupOffset
+	} else {
+		//delay start of monitoring randomly to desync the probing of the monitoring-coroutines
+		offset = time.Duration(rand.Int()%20000) * time.Millisecond
+	}
+	if !sleep(ctx, offset) {
 		return
 	}
+	slog.Info("Started monitoring", "config", c.Name)
+	for {
+		if globalconf.PauseProbesInMaintenance && inMaintenance(c.Name) {
+			slog.Debug("config in maintenance, skipping probe", "config", c.Name)
+		} else {
+			go recoveringProbe(ctx, c)
+		}
+		if !sleep(ctx, jitter(c.interval())) {
+			slog.Info("Stopped monitoring", "config", c.Name)
+			return
+		}
+	}
+}
 
-	timeout := time.After(globalconf.MailCheckTimeout)
-	select {
-	case mail := <-muxer[p.token]:
-		logDebug.Println("checking mail for timeout")
-
-		deliverOk.WithLabelValues(c.Name).Set(1)
-		deleteMailIfEnabled(mail)
+// recoveringProbe runs probe, recovering from panics so that a bug hit by one server
+// fails only the current probe instead of the whole exporter.
+func recoveringProbe(ctx context.Context, c smtpServerConfig) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("probe panicked", "config", c.Name, "panic", r, "stack", string(debug.Stack()))
+			monitorPanics.WithLabelValues(c.Name).Inc()
+		}
+	}()
+	probe(ctx, c)
+}
 
-	case <-timeout:
-		logWarn.Println("Delivery-Timeout, Message-ID: " + createMsgId(c, p.String()))
-		deliverOk.WithLabelValues(c.Name).Set(0)
+// jitter varies d randomly by up to IntervalJitter in both directions.
+func jitter(d time.Duration) time.Duration {
+	if globalconf.IntervalJitter == 0 {
+		return d
 	}
+	return time.Duration(float64(d) * (1 + globalconf.IntervalJitter*(2*rand.Float64()-1)))
+}
 
-	disposeToken <- p.token
+// sleep waits for d and reports false if ctx was cancelled before.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
-// monitor probes every MonitoringInterval if mail still gets through.
-func monitor(c smtpServerConfig) {
-	//delay start of monitoring randomly to desync the probing of the monitoring-coroutines
-	time.Sleep(time.Duration(rand.Int()%20000) * time.Millisecond)
-	log.Println("Started monitoring for config", c.Name)
-	for {
-		p := newPayload(c.Name)
-		go probe(c, p)
-		time.Sleep(globalconf.MonitoringInterval)
+// deliverDuration is the time it took to deliver m, clamped to 0 for skewed clocks
+// so that no negative durations end up in the metrics.
+func (m email) deliverDuration() time.Duration {
+	if d := m.tRecv.Sub(m.tSent); d > 0 {
+		return d
 	}
+	return 0
 }
 
 // classifyMailMetrics extracts all general mail metrics such as deliver duration etc.
@@ -409,54 +2372,460 @@ func classifyMailMetrics(foundMail email) {
 	// last_mail_deliver_time shall be standard unix-timestamp
 	// last_mail_deliver_duration shall be seconds (SI-Units)
 	deliverTime := float64(foundMail.tRecv.Unix())
-	deliverDuration := foundMail.tRecv.Sub(foundMail.tSent).Seconds()
+	if foundMail.tRecv.Before(foundMail.tSent) {
+		slog.Warn("mail received before it was sent, clocks of sender and receiver are skewed", "config", foundMail.configname, "skew", foundMail.tSent.Sub(foundMail.tRecv))
+		clockSkewEvents.WithLabelValues(foundMail.configname).Inc()
+	}
+	deliverDuration := foundMail.deliverDuration().Seconds()
 	lastMailDeliverTime.WithLabelValues(foundMail.configname).Set(deliverTime)
-	mailDeliverDuration.process(foundMail.configname, deliverDuration)
+	mailDeliverDuration.process(foundMail.configname, deliverDuration, foundMail.token)
 }
 
 // detectAndMuxMail monitors Detectiondirs, reports mails that come in to the goroutine they belong to
-// and takes care of removing unneeded report channels
-func detectAndMuxMail(watcher *fsnotify.Watcher) {
-	log.Println("Started mail-detection.")
+// and takes care of removing unneeded report channels. Once ctx is cancelled, it stops the parse workers
+// and the watcher and closes detectionStopped.
+func detectAndMuxMail(ctx context.Context, watcher *fsnotify.Watcher, unwatched map[string]bool) {
+	slog.Info("Started mail-detection")
+
+	// tokens already detected with the time of detection, so that a recreated delivery of
+	// the same mail is neither handed over again nor counted late or early once more
+	delivered := make(map[string]time.Time)
+
+	// parsing is done by workers so that slow reads don't hold up detection;
+	// paths not yet taken by a worker wait in backlog, keeping this goroutine
+	// from ever blocking on the queue while workers wait to report to it
+	queue := make(chan string)
+	parsed := make(chan email)
+	var workers sync.WaitGroup
+	for i := 0; i < globalconf.ParseWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			parseWorker(ctx, queue, parsed)
+		}()
+	}
+	var backlog []string
+
+	// while the watcher is dead, its channels are nil and recreating it is retried
+	events, errs := watcher.Events, watcher.Errors
+	var retry <-chan time.Time
+
+	// Detectiondirs that are missing, e.g. after being removed, are retried to be watched
+	rewatch := time.NewTicker(watcherRetryInterval)
+	defer rewatch.Stop()
 
 	for {
+		var next string
+		var enqueue chan<- string
+		if len(backlog) > 0 {
+			next, enqueue = backlog[0], queue
+		}
+
+		var rewatchC <-chan time.Time
+		if len(unwatched) > 0 && events != nil {
+			rewatchC = rewatch.C
+		}
+
 		select {
-		case event := <-watcher.Events:
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				if foundMail, err := parseMail(event.Name); err == nil {
-
-					// first of all: classify the mail
-					classifyMailMetrics(foundMail)
-
-					// then hand over so the timeout is judged
-					if ch, ok := muxer[foundMail.token]; ok {
-						ch <- foundMail
-					} else {
-						handleLateMail(foundMail)
+		case event, ok := <-events:
+			if !ok {
+				slog.Error("filesystem-watcher died, mail-detection stopped until it is recreated")
+				exporterUp.Set(0)
+				watcherClose(watcher)
+				events, errs = nil, nil
+				retry = time.After(0)
+				continue
+			}
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				if ok, _ := isDetectionDir(filepath.Clean(event.Name)); ok {
+					slog.Warn("detectiondir vanished, retrying to watch it", "dir", event.Name)
+					watcher.Remove(event.Name) // still watched if only renamed
+					unwatched[filepath.Clean(event.Name)] = true
+					updateWatchUp(unwatched)
+					continue
+				}
+			}
+			if event.Op&fsnotify.Create == fsnotify.Create && !isArchived(event.Name) {
+				if isRecursivelyWatched(event.Name) {
+					if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+						for _, path := range watchNewDir(watcher, event.Name) {
+							if isCandidate(path) {
+								backlog = append(backlog, path)
+							}
+						}
+						continue
 					}
 				}
+
+				if isCandidate(event.Name) {
+					backlog = append(backlog, event.Name)
+				} else {
+					slog.Debug("skipping file not matching any filenamepattern", "file", event.Name)
+				}
+			}
+		case enqueue <- next:
+			backlog = backlog[1:]
+		case foundMail := <-parsed:
+			dispatchMail(foundMail, delivered)
+		case err, ok := <-errs:
+			if !ok {
+				slog.Error("filesystem-watcher died, mail-detection stopped until it is recreated")
+				exporterUp.Set(0)
+				watcherClose(watcher)
+				events, errs = nil, nil
+				retry = time.After(0)
+				continue
+			}
+			slog.Warn("watcher-error", "err", err)
+		case <-retry:
+			w, u, err := newDetectionWatcher()
+			if err != nil {
+				slog.Warn("error recreating filesystem-watcher, retrying", "err", err)
+				retry = time.After(watcherRetryInterval)
+				continue
+			}
+			slog.Info("filesystem-watcher recreated, mail-detection resumed")
+			watcher, unwatched, events, errs, retry = w, u, w.Events, w.Errors, nil
+			exporterUp.Set(1)
+		case <-rewatchC:
+			for _, path := range rewatchDirs(watcher, unwatched) {
+				if isCandidate(path) {
+					backlog = append(backlog, path)
+				}
 			}
-		case err := <-watcher.Errors:
-			logWarn.Println("watcher-error:", err)
+		case r := <-registerToken:
+			muxer[r.token] = r.reports
 		case token := <-disposeToken:
-			// deletion of channels is done here to avoid interference with the report-case of this goroutine
-			close(muxer[token])
+			// deletion of channels is done here to avoid interference with the report-case of this goroutine;
+			// they are not closed as a channel may be shared by the tokens of one probe
 			delete(muxer, token)
+		case <-ctx.Done():
+			// reports are never sent blocking, so probes are not waited for; workers still
+			// parsing give up on reporting, idle ones end with the queue, and both are
+			// waited for so that no mail is parsed anymore once detection stopped
+			close(queue)
+			workers.Wait()
+			watcherClose(watcher)
+			close(detectionStopped)
+			slog.Info("Stopped mail-detection")
+			return
+		}
+	}
+}
+
+// watcherRetryInterval is the time between attempts to recreate a dead filesystem-watcher
+// and to watch missing Detectiondirs, replaceable to shorten waiting for them.
+var watcherRetryInterval = 10 * time.Second
+
+// newDetectionWatcher creates a filesystem-watcher watching the Detectiondirs of all servers,
+// also returning the ones that could not be watched.
+func newDetectionWatcher() (*fsnotify.Watcher, map[string]bool, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unwatched, err := watchDetectionDirs(watcher)
+	if err != nil {
+		watcherClose(watcher)
+		return nil, nil, err
+	}
+	return watcher, unwatched, nil
+}
+
+// watchDetectionDirs adds the Detectiondirs of all servers to watcher, updating
+// mail_detection_watch_up, and returns the ones that could not be watched.
+// Failures are only returned as error if FailOnWatchError is set.
+func watchDetectionDirs(watcher *fsnotify.Watcher) (map[string]bool, error) {
+	unwatched := make(map[string]bool)
+	for _, c := range globalconf.Servers {
+		for _, dir := range c.detectionDirs() {
+			slog.Debug("adding path to watcher", "dir", dir)
+			errAdd := addWatch(watcher, dir, c.WatchRecursive) // deduplication is done within fsnotify
+			if errAdd != nil {
+				if globalconf.FailOnWatchError {
+					return nil, fmt.Errorf("server %s: %s: %s", c.Name, dir, errAdd)
+				}
+				slog.Warn("error adding filesystem-watcher", "config", c.Name, "dir", dir, "err", errAdd)
+				unwatched[filepath.Clean(dir)] = true
+			}
+		}
+	}
+	updateWatchUp(unwatched)
+	return unwatched, nil
+}
+
+// updateWatchUp sets mail_detection_watch_up of every server to 0 if any of its
+// Detectiondirs is unwatched, to 1 otherwise.
+func updateWatchUp(unwatched map[string]bool) {
+	for _, c := range globalconf.Servers {
+		up := 1.0
+		for _, dir := range c.detectionDirs() {
+			if unwatched[filepath.Clean(dir)] {
+				up = 0
+			}
+		}
+		detectionWatchUp.WithLabelValues(c.Name).Set(up)
+	}
+}
+
+// isDetectionDir tells if path is a Detectiondir itself, returning whether any server
+// having it watches it recursively.
+func isDetectionDir(path string) (ok bool, recursive bool) {
+	for _, c := range globalconf.Servers {
+		for _, dir := range c.detectionDirs() {
+			if filepath.Clean(dir) == path {
+				ok = true
+				recursive = recursive || c.WatchRecursive
+			}
+		}
+	}
+	return ok, recursive
+}
+
+// rewatchDirs retries watching the dirs of unwatched, removing those that succeed and
+// returning the files that ended up in them meanwhile.
+func rewatchDirs(watcher *fsnotify.Watcher, unwatched map[string]bool) []string {
+	var paths []string
+	for dir := range unwatched {
+		_, recursive := isDetectionDir(dir)
+		if err := addWatch(watcher, dir, recursive); err != nil {
+			slog.Debug("detectiondir still not watchable", "dir", dir, "err", err)
+			continue
+		}
+		slog.Info("detectiondir watched again", "dir", dir)
+		delete(unwatched, dir)
+		paths = append(paths, existingFiles(dir, recursive)...)
+	}
+	updateWatchUp(unwatched)
+	return paths
+}
+
+// parseWorker parses the mails at the paths received from queue, reporting probing-mails to parsed,
+// until queue is closed or ctx is cancelled.
+func parseWorker(ctx context.Context, queue <-chan string, parsed chan<- email) {
+	for path := range queue {
+		if foundMail, err := parseMail(path); err == nil {
+			select {
+			case parsed <- foundMail:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// dispatchMail classifies a found mail and hands it over to the probe waiting for it.
+func dispatchMail(foundMail email, delivered map[string]time.Time) {
+	forgetDeliveredTokens(delivered)
+	if _, ok := delivered[foundMail.token]; ok {
+		slog.Debug("ignoring duplicate delivery", "token", foundMail.token)
+		deleteMailIfEnabled(foundMail)
+		return
+	}
+
+	// first of all: classify the mail
+	classifyMailMetrics(foundMail)
+
+	// then hand over so the timeout is judged
+	if ch, ok := muxer[foundMail.token]; ok {
+		select {
+		case ch <- foundMail:
+			// tRecv is taken when parsing starts
+			detectionDuration.WithLabelValues(foundMail.configname).Observe(now().Sub(foundMail.tRecv).Seconds())
+		default:
+			slog.Warn("probe not accepting reports, dropping mail", "config", foundMail.configname, "token", foundMail.token)
+			reportsDropped.WithLabelValues(foundMail.configname).Inc()
+			deleteMailIfEnabled(foundMail)
+		}
+	} else {
+		handleLateMail(foundMail)
+	}
+	// late and early mails as well, so that an MTA delivering them twice doesn't count them twice
+	delivered[foundMail.token] = now()
+}
+
+// addWatch adds dir to the watcher, including all of its subdirectories if recursive.
+func addWatch(watcher *fsnotify.Watcher, dir string, recursive bool) error {
+	if !recursive {
+		return watcher.Add(dir)
+	}
+
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		slog.Debug("adding path to watcher", "dir", path)
+		return watcher.Add(path)
+	})
+}
+
+// isArchived tells if path lies within the ArchiveDir, as archived mails must not be detected again.
+func isArchived(path string) bool {
+	return globalconf.ArchiveDir != "" && strings.HasPrefix(path, filepath.Clean(globalconf.ArchiveDir)+string(filepath.Separator))
+}
+
+// isCandidate tells if the file at path could be a probing-mail, i.e. if its name matches
+// the FilenamePattern of any server whose Detectiondirs it lies in; it is if no server claims it.
+func isCandidate(path string) bool {
+	claimed := false
+	for _, c := range globalconf.Servers {
+		if !inDetectionDirs(c, path) {
+			continue
+		}
+		if c.FilenamePattern == "" {
+			return true
+		}
+		if ok, _ := filepath.Match(c.FilenamePattern, filepath.Base(path)); ok {
+			return true
+		}
+		claimed = true
+	}
+	return !claimed
+}
+
+// inDetectionDirs tells if path lies within one of the Detectiondirs of config c.
+func inDetectionDirs(c smtpServerConfig, path string) bool {
+	for _, dir := range c.detectionDirs() {
+		dir = filepath.Clean(dir)
+		if filepath.Dir(path) == dir {
+			return true
+		}
+		if c.WatchRecursive && strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRecursivelyWatched tells if path lies within a Detectiondir of a server with WatchRecursive.
+func isRecursivelyWatched(path string) bool {
+	for _, c := range globalconf.Servers {
+		if !c.WatchRecursive {
+			continue
+		}
+		for _, dir := range c.detectionDirs() {
+			if strings.HasPrefix(path, filepath.Clean(dir)+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watchNewDir adds a directory created within a recursively watched Detectiondir to the watcher
+// and returns the files that ended up in it before the watch was in place for them to be parsed.
+func watchNewDir(watcher *fsnotify.Watcher, dir string) []string {
+	if err := addWatch(watcher, dir, true); err != nil {
+		slog.Warn("error adding filesystem-watcher", "dir", dir, "err", err)
+	}
+	return existingFiles(dir, true)
+}
+
+// existingFiles returns the regular files in dir, including those of its subdirectories if recursive.
+func existingFiles(dir string, recursive bool) []string {
+	var paths []string
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
 		}
+		if fi.IsDir() && path != dir && !recursive {
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths
+}
+
+// forgetDeliveredTokens removes all tokens from delivered that were detected
+// longer ago than the configured DuplicateWindow.
+func forgetDeliveredTokens(delivered map[string]time.Time) {
+	for token, t := range delivered {
+		if now().Sub(t) > globalconf.DuplicateWindow {
+			delete(delivered, token)
+		}
+	}
+}
+
+// sweepStaleMails periodically deletes probing-mails from the Detectiondirs that are too old
+// to ever be matched by a probe, e.g. because their token got lost on a restart.
+// It returns once ctx is cancelled.
+func sweepStaleMails(ctx context.Context) {
+	maxAge := time.Duration(globalconf.StaleMailFactor) * maxTimeout()
+	slog.Info("Started sweeping of stale probing-mails", "maxage", maxAge)
+
+	for {
+		if !sleep(ctx, maxTimeout()) {
+			slog.Info("Stopped sweeping of stale probing-mails")
+			return
+		}
+
+		swept := make(map[string]bool) // Detectiondirs are often shared between servers
+		for _, c := range globalconf.Servers {
+			for _, dir := range c.detectionDirs() {
+				if swept[dir] {
+					continue
+				}
+				swept[dir] = true
+				sweepDir(dir, maxAge)
+			}
+		}
+	}
+}
+
+// sweepDir deletes the probing-mails in dir sent longer than maxAge ago.
+func sweepDir(dir string, maxAge time.Duration) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		slog.Warn("error reading Detectiondir for sweeping", "dir", dir, "err", err)
+		return
+	}
+
+	for _, fi := range files {
+		path := filepath.Join(dir, fi.Name())
+		if !fi.Mode().IsRegular() || !isCandidate(path) {
+			continue
+		}
+
+		m, err := parseMail(path)
+		if err != nil || now().Sub(m.tSent) < maxAge {
+			continue
+		}
+
+		slog.Debug("sweeping stale mail", "file", m.filename)
+		staleMailsSwept.WithLabelValues(m.configname).Inc()
+		deleteMailIfEnabled(m)
 	}
 }
 
 func fileClose(f *os.File) {
 	err := f.Close()
 	if err != nil {
-		logWarn.Println("error when closing file:", err)
+		slog.Warn("error when closing file", "err", err)
 	}
 }
 
 // parseMail reads a mailfile's content and parses it into a mail-struct if one of ours.
 func parseMail(path string) (email, error) {
 	// to date the mails found
-	t := time.Now()
+	t := now()
+
+	// huge files in shared Maildirs are skipped before reading anything of them,
+	// as reading the headers in full could exhaust memory otherwise
+	fi, err := os.Stat(path)
+	if err != nil {
+		return email{}, err
+	}
+	if fi.Size() > globalconf.MaxMailFileBytes {
+		slog.Warn("skipping file larger than maxmailfilebytes", "file", path, "size", fi.Size())
+		return email{}, errNotOurDept
+	}
 
 	// try parsing
 	f, err := os.Open(path)
@@ -465,107 +2834,254 @@ func parseMail(path string) (email, error) {
 	}
 	defer fileClose(f)
 
-	mail, err := mail.ReadMessage(io.LimitReader(f, 8192))
+	// headers are read in full, as bulky ones (DKIM, ARC, Received-chains) would otherwise
+	// push the payload out of reach; only the body is limited
+	mail, err := mail.ReadMessage(f)
 	if err != nil {
 		return email{}, err
 	}
 
-	payl, err := ioutil.ReadAll(mail.Body)
+	// the header survives gateways rewriting bodies, so prefer it if present
+	p, err := decomposePayload([]byte(strings.TrimSpace(mail.Header.Get(payloadHeader))))
 	if err != nil {
-		return email{}, err
+		body := io.LimitReader(mail.Body, globalconf.MaxMailReadBytes)
+		p, err = findPayload(mail.Header.Get("Content-Type"), mail.Header.Get("Content-Transfer-Encoding"), body, 0)
 	}
-	payloadbytes := bytes.TrimSpace(payl) // mostly for trailing "\n"
-
-	p, err := decomposePayload(payloadbytes)
 	// return if parsable
 	// (non-parsable mails are not sent by us (or broken) and therefore not needed
 	if err != nil {
+		slog.Debug("not one of our mails", "file", path)
 		return email{}, errNotOurDept
 	}
 
+	slog.Debug("found probing-mail", "file", path, "config", p.configname, "token", p.token)
 	return email{path, p.configname, p.token, time.Unix(0, p.timestamp), t}, nil
 }
 
+// maxMIMEDepth limits how deep nested multipart-mails are searched for a payload.
+const maxMIMEDepth = 5
+
+// findPayload searches the body of a mail or mail part with the given Content-Type and
+// Content-Transfer-Encoding for a payload, walking all text parts of multipart-mails.
+func findPayload(contentType, encoding string, body io.Reader, depth int) (payload, error) {
+	mediaType := "text/plain"
+	params := map[string]string{}
+	if contentType != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(contentType); err != nil {
+			return payload{}, errNotOurDept
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth {
+			return payload{}, errNotOurDept
+		}
+
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				// io.EOF as well as broken mails end the search
+				return payload{}, errNotOurDept
+			}
+
+			// quoted-printable is already decoded by the multipart-reader
+			p, err := findPayload(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part, depth+1)
+			if err == nil {
+				return p, nil
+			}
+		}
+	}
+
+	if !strings.HasPrefix(mediaType, "text/") {
+		return payload{}, errNotOurDept
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	text, err := ioutil.ReadAll(body)
+	if err != nil {
+		return payload{}, err
+	}
+
+	return searchPayload(text)
+}
+
+// searchPayload looks for a payload in text, which is either all of it or one of its lines,
+// so that payloads survive footers or other text being added around them.
+func searchPayload(text []byte) (payload, error) {
+	p, err := decomposePayload(bytes.TrimSpace(text)) // mostly for trailing "\n"
+	if err == nil {
+		return p, nil
+	}
+
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if p, err := decomposePayload(line); err == nil {
+			return p, nil
+		}
+	}
+
+	return payload{}, errNotOurDept
+}
+
+// checkServers connects and authenticates to every configured SMTP-server without sending
+// anything, reports the outcome per server and tells if all of them succeeded.
+func checkServers() bool {
+	ok := true
+	for _, c := range globalconf.Servers {
+		client, err := connect(context.Background(), c)
+		if err == nil {
+			err = client.Quit()
+		}
+
+		if err != nil {
+			fmt.Printf("%s: FAIL: %s\n", c.Name, err)
+			ok = false
+		} else {
+			fmt.Printf("%s: OK\n", c.Name)
+		}
+	}
+	return ok
+}
+
 func watcherClose(w *fsnotify.Watcher) {
 	err := w.Close()
 	if err != nil {
-		logWarn.Println("error when closing watcher:", err)
+		slog.Warn("error when closing watcher", "err", err)
 	}
 }
 
 func main() {
 	flag.Parse()
 	if *version {
-		logInfo.Println("Prometheus-Mailexporter")
-		logInfo.Printf(" :: version %s", "dev")
-		logInfo.Printf(" :: Go-version: %s", runtime.Version())
+		fmt.Println("Prometheus-Mailexporter")
+		fmt.Printf(" :: version %s\n", buildVersion)
+		fmt.Printf(" :: revision %s\n", buildRevision)
+		fmt.Printf(" :: Go-version: %s\n", runtime.Version())
 		os.Exit(0)
 	}
 
-	// handle log-verbosity
-	if *verbosity < 1 {
-		// disable everything except error logs
-		logInfo.SetOutput(ioutil.Discard)
-		logWarn.SetOutput(ioutil.Discard)
+	if *generateConfig {
+		fmt.Print(exampleConfig)
+		os.Exit(0)
 	}
-	if *verbosity < 2 {
+
+	// handle log-verbosity, an explicit -log.level takes precedence over -v
+	switch {
+	case *logLevelName != "":
+		if err := logLevel.UnmarshalText([]byte(*logLevelName)); err != nil {
+			fatal("invalid -log.level", "err", err)
+		}
+	case *verbosity < 1:
+		// disable everything except error logs
+		logLevel.Set(slog.LevelError)
+	case *verbosity < 2:
 		// disable Debug-logs (default)
-		logDebug.SetOutput(ioutil.Discard)
+		logLevel.Set(slog.LevelInfo)
+	default:
+		logLevel.Set(slog.LevelDebug)
 	}
 
-	// handle log-timestamping
-	if *logTimestamps {
-		logInfo.SetFlags(3)
-		logWarn.SetFlags(3)
-		logDebug.SetFlags(3)
-		logError.SetFlags(3)
+	if err := setupLogging(*logFormat, *logTimestamps); err != nil {
+		fatal("error setting up logging", "err", err)
 	}
 
+	startTime = now()
+	registerMetrics(registry)
+
 	// seed the RNG, otherwise we would have same randomness on every startup
 	// which should not, but might in worst case interfere with leftover-mails
 	// from earlier starts of the binary
 	rand.Seed(time.Now().Unix())
 
-	f, err := os.Open(*confPath)
+	files, err := configFiles(*confPath)
 	if err != nil {
-		logError.Fatal(err)
+		fatal("error opening config file", "err", err)
 	}
-	defer fileClose(f)
 
-	err = parseConfig(f)
+	err = parseConfig(files)
 	if err != nil {
-		logError.Fatal(err)
+		fatal("error parsing config file", "err", err)
 	}
 
-	// initialize Metrics that will be used seldom so that they actually get exported with a metric
-	for _, c := range globalconf.Servers {
-		lateMails.WithLabelValues(c.Name)
-		mailSendFails.WithLabelValues(c.Name)
+	if globalconf.LogLevel != "" && *logLevelName == "" {
+		// already validated in parseConfig
+		logLevel.UnmarshalText([]byte(globalconf.LogLevel))
 	}
 
-	fswatcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		logError.Fatal(err)
+	if *checkConfig {
+		if !checkServers() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if globalconf.MaxConcurrentProbes > 0 {
+		probeSlots = make(chan struct{}, globalconf.MaxConcurrentProbes)
 	}
-	defer watcherClose(fswatcher)
 
 	for _, c := range globalconf.Servers {
-		logDebug.Println("adding path to watcher:", c.Detectiondir)
-		errAdd := fswatcher.Add(c.Detectiondir) // deduplication is done within fsnotify
-		if errAdd != nil {
-			logWarn.Printf("error adding filesystem-watcher to %s: %s\n", c.Detectiondir, errAdd)
+		initMetrics(c)
+		initStatus(c.Name)
+
+		if len(c.SLOs) > 0 {
+			durationWindows[c.Name] = newDurationWindow(c.SLOs, globalconf.SLOWindow)
 		}
 	}
 
-	go detectAndMuxMail(fswatcher)
+	fswatcher, unwatched, err := newDetectionWatcher()
+	if err != nil {
+		fatal("error setting up filesystem-watcher", "err", err)
+	}
+
+	// SIGINT and SIGTERM cancel in-flight probes and stop monitoring and mail-detection
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go detectAndMuxMail(ctx, fswatcher, unwatched)
+	exporterUp.Set(1)
+
+	// with no servers, there is nothing to sweep and no timeout to sweep at
+	if globalconf.StaleMailFactor > 0 && !globalconf.DisableFileDeletion && len(globalconf.Servers) > 0 {
+		go sweepStaleMails(ctx)
+	}
 
 	//starts monitoring goroutines for specified SMTP-server
-	for _, c := range globalconf.Servers {
-		go monitor(c)
+	for i, c := range globalconf.Servers {
+		go monitor(ctx, c, i)
+	}
+
+	if globalconf.Pushgateway != nil {
+		go pushMetrics(ctx, *globalconf.Pushgateway)
 	}
 
-	log.Println("Starting HTTP-endpoint")
-	http.Handle(*httpEndpoint, promhttp.Handler())
+	slog.Info("Starting HTTP-endpoint", "address", listenAddress())
+	srv, err := newServer(listenAddress(), newMux(*httpEndpoint, newMetricsHandler(registry)))
+	if err != nil {
+		fatal("error setting up HTTP-server", "err", err)
+	}
 
-	logError.Fatal(http.ListenAndServe(*webListenAddress, nil))
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		slog.Info("shutting down")
+		srv.Shutdown(context.Background())
+		drainPooledConns()
+		close(stopped)
+	}()
+
+	if err := serve(srv); err != http.ErrServerClosed {
+		fatal("HTTP-server failed", "err", err)
+	}
+	<-stopped
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetConfig discards the configuration parsed by a previous test and the statuses of its servers.
+func resetConfig(t testing.TB) {
+	t.Helper()
+	globalconf = config{}
+	resetStatuses()
+	t.Cleanup(func() {
+		globalconf = config{}
+		// probes finishing in the background may still update them
+		resetStatuses()
+	})
+}
+
+// resetStatuses discards the statuses of all servers.
+func resetStatuses() {
+	statuses.Lock()
+	defer statuses.Unlock()
+	statuses.servers = nil
+}
+
+// writeConfig writes content to a config file in a temporary directory and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mailexporter.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fakeClock makes now return the time pointed to by the returned pointer until the test ends.
+func fakeClock(t testing.TB, start time.Time) *time.Time {
+	t.Helper()
+	current := start
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+	return &current
+}
+
+func TestExampleConfigParses(t *testing.T) {
+	resetConfig(t)
+
+	if err := parseConfig([]string{writeConfig(t, exampleConfig)}); err != nil {
+		t.Fatalf("example config does not parse: %s", err)
+	}
+	if len(globalconf.Servers) != 2 {
+		t.Errorf("got %d servers, want 2", len(globalconf.Servers))
+	}
+}
+
+func TestPerServerTimeoutOnly(t *testing.T) {
+	resetConfig(t)
+
+	err := parseConfig([]string{writeConfig(t, `
+monitoringinterval: 1m
+servers:
+    - name: a
+      server: localhost
+      port: 25
+      from: probe@example.com
+      to: probe@example.com
+      detectiondir: /tmp
+      mailchecktimeout: 30s
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if globalconf.DuplicateWindow != 30*time.Second {
+		t.Errorf("duplicatewindow defaulted to %s, want the server's 30s", globalconf.DuplicateWindow)
+	}
+}
+
+func TestMissingTimeoutRejected(t *testing.T) {
+	resetConfig(t)
+
+	err := parseConfig([]string{writeConfig(t, `
+monitoringinterval: 1m
+servers:
+    - name: a
+      server: localhost
+      port: 25
+      from: probe@example.com
+      to: probe@example.com
+      detectiondir: /tmp
+`)})
+	if err == nil {
+		t.Fatal("config without any mailchecktimeout accepted")
+	}
+}
+
+func TestAddressesValidated(t *testing.T) {
+	for addr, valid := range map[string]bool{
+		"probe@example.com":                    true,
+		"probe+relay@mail.example.com":         true,
+		"probe":                                false,
+		"probe@":                               false,
+		"@example.com":                         false,
+		"probe@@example.com":                   false,
+		"probe@example.com, other@example.com": false,
+		"Probe <probe@example.com>":            false,
+		"<probe@example.com>":                  false,
+		"":                                     false,
+	} {
+		for _, field := range []string{"from", "to"} {
+			resetConfig(t)
+			server := map[string]string{"from": "probe@example.com", "to": "probe@example.com"}
+			server[field] = addr
+			err := parseConfig([]string{writeConfig(t, fmt.Sprintf(`
+monitoringinterval: 1m
+mailchecktimeout: 1m
+servers:
+    - name: addressed
+      server: localhost
+      port: 25
+      from: %q
+      to: %q
+      detectiondir: /tmp
+`, server["from"], server["to"]))})
+			if valid && err != nil {
+				t.Errorf("%s %q rejected: %s", field, addr, err)
+			}
+			if !valid && (err == nil || !strings.Contains(err.Error(), "server addressed") || !strings.Contains(err.Error(), field)) {
+				t.Errorf("%s %q not rejected naming server and field: %v", field, addr, err)
+			}
+		}
+	}
+}
+
+func TestPayloadSeparator(t *testing.T) {
+	for sep, valid := range map[string]bool{
+		"-":    true,
+		"_":    true,
+		"+=+":  true,
+		"~":    true,
+		"\x00": false,
+		" ":    false,
+		"<":    false,
+		">":    false,
+		"@":    false,
+		"\"":   false,
+		".":    false,
+		"a":    false,
+		"1":    false,
+		"\r\n": false,
+		"ä":    false,
+	} {
+		resetConfig(t)
+		globalconf.MonitoringInterval = time.Minute
+		globalconf.MailCheckTimeout = time.Minute
+		globalconf.PayloadSeparator = sep
+		err := validateConfig()
+		if valid && err != nil {
+			t.Errorf("separator %q rejected: %s", sep, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("separator %q accepted", sep)
+		}
+	}
+}
+
+func TestSubjectTemplate(t *testing.T) {
+	for subject, want := range map[string]string{
+		"":                            "mailexporter-probe",
+		"probe":                       "probe",
+		"probe of {{.Name}}":          "probe of relay",
+		"{{.Name}} [{{.Token}}]":      "relay [abc123]",
+		"{{printf \"%.3s\" .Token}}":  "abc",
+		"{{.Name":                     "",
+		"{{.Missing}}":                "",
+		"probe\r\nBcc: x@example.com": "",
+		"{{.Name}}\n":                 "",
+	} {
+		resetConfig(t)
+		globalconf.MonitoringInterval = time.Minute
+		globalconf.MailCheckTimeout = time.Minute
+		globalconf.Subject = subject
+		err := validateConfig()
+		if want == "" {
+			if err == nil {
+				t.Errorf("subject %q accepted", subject)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("subject %q rejected: %s", subject, err)
+			continue
+		}
+		got, err := renderSubject(smtpServerConfig{Name: "relay"}, payload{token: "abc123"})
+		if err != nil || got != want {
+			t.Errorf("subject %q rendered as %q (%v), want %q", subject, got, err, want)
+		}
+	}
+}
+
+func TestSendsThrottled(t *testing.T) {
+	clock := fakeClock(t, time.Unix(1000, 0))
+	c := smtpServerConfig{Name: "throttled", MaxSendsPerMinute: 2}
+	t.Cleanup(func() { delete(sendBudgets.configs, c.Name) })
+
+	for i, want := range []bool{true, true, false} {
+		if got := takeSend(c); got != want {
+			t.Errorf("send %d allowed: %t, want %t", i, got, want)
+		}
+	}
+
+	// refills at two sends per minute
+	*clock = clock.Add(30 * time.Second)
+	if !takeSend(c) {
+		t.Error("send refused after refilling one")
+	}
+	if takeSend(c) {
+		t.Error("send allowed beyond the refilled one")
+	}
+
+	if !takeSend(smtpServerConfig{Name: "unlimited"}) {
+		t.Error("send refused without maxsendsperminute")
+	}
+}
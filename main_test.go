@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMainProcess runs main with the arguments in MAILEXPORTER_ARGS when started by
+// runMain, and does nothing otherwise.
+func TestMainProcess(t *testing.T) {
+	args := os.Getenv("MAILEXPORTER_ARGS")
+	if args == "" {
+		return
+	}
+	os.Args = append([]string{"mailexporter"}, strings.Fields(args)...)
+	main()
+}
+
+// runMain runs mailexporter with args in a separate process and returns its exit code
+// and output.
+func runMain(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainProcess$")
+	cmd.Env = append(os.Environ(), "MAILEXPORTER_ARGS="+strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode(), string(out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(out)
+}
+
+// startMain starts mailexporter with args in a separate process, interrupting it
+// at the end of the test.
+func startMain(t *testing.T, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainProcess$")
+	cmd.Env = append(os.Environ(), "MAILEXPORTER_ARGS="+strings.Join(args, " "))
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+// freeAddress returns a local address no one listens on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+// waitHealthy polls /-/healthy at addr until it answers or timeout passed.
+func waitHealthy(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := http.Get("http://" + addr + "/-/healthy")
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestConfigCheckExitCodes(t *testing.T) {
+	stub := newSMTPStub(t)
+	code, out := runMain(t, "-config.check", "-config.file", writeConfig(t, stubConfig(stub, "reachable")))
+	if code != 0 || !strings.Contains(out, "reachable: OK") {
+		t.Errorf("check of a reachable server exited with %d: %s", code, out)
+	}
+
+	_, stub.port, _ = net.SplitHostPort(freeAddress(t))
+	code, out = runMain(t, "-config.check", "-config.file", writeConfig(t, stubConfig(stub, "unreachable")))
+	if code != 1 || !strings.Contains(out, "unreachable: FAIL") {
+		t.Errorf("check of an unreachable server exited with %d: %s", code, out)
+	}
+
+	code, out = runMain(t, "-config.check", "-config.file", writeConfig(t, "bogus: key\n"))
+	if code != 1 {
+		t.Errorf("check of an invalid config exited with %d: %s", code, out)
+	}
+}
+
+func TestServingBeforeStartupOffsets(t *testing.T) {
+	stub := newSMTPStub(t)
+	conf := "startupoffset: 1h\n" + stubConfig(stub, "first") + stubServer(stub, "second")
+
+	addr := freeAddress(t)
+	startMain(t, "-config.file", writeConfig(t, conf), "-web.listen-address", addr)
+	// the second server starts probing only after an hour
+	if err := waitHealthy(addr, 10*time.Second); err != nil {
+		t.Fatalf("HTTP-endpoint not reachable: %s", err)
+	}
+}
+
+func TestServerCounts(t *testing.T) {
+	stub := newSMTPStub(t)
+	conf := stubConfig(stub, "first") + stubServer(stub, "second") + stubServer(stub, "disabled", "enabled: false")
+
+	addr := freeAddress(t)
+	startMain(t, "-config.file", writeConfig(t, conf), "-web.listen-address", addr)
+	if err := waitHealthy(addr, 10*time.Second); err != nil {
+		t.Fatalf("HTTP-endpoint not reachable: %s", err)
+	}
+
+	// monitors are started concurrently to serving
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		configured := strings.Contains(string(body), "\nmailexporter_servers_configured 3\n")
+		active := strings.Contains(string(body), "\nmailexporter_servers_active 2\n")
+		if configured && active {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 3 servers configured and 2 active, got configured %t, active %t in\n%s", configured, active, body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestListenAddressBindsInterface(t *testing.T) {
+	stub := newSMTPStub(t)
+	addr := freeAddress(t)
+	_, port, _ := net.SplitHostPort(addr)
+	startMain(t, "-config.file", writeConfig(t, "listenaddress: "+addr+"\n"+stubConfig(stub, "bound")))
+	if err := waitHealthy(addr, 10*time.Second); err != nil {
+		t.Fatalf("HTTP-endpoint not reachable on the listenaddress: %s", err)
+	}
+
+	// all of 127.0.0.0/8 is local, but only 127.0.0.1 is listened on
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err == nil {
+		conn.Close()
+		t.Error("HTTP-endpoint reachable on another interface than the listenaddress")
+	}
+}
+
+func TestFailOnWatchError(t *testing.T) {
+	stub := newSMTPStub(t)
+	stub.maildir = filepath.Join(stub.maildir, "nonexistent")
+	conf := stubConfig(stub, "unwatchable")
+
+	code, out := runMain(t, "-config.file", writeConfig(t, "failonwatcherror: true\n"+conf))
+	if code != 1 || !strings.Contains(out, "unwatchable") {
+		t.Errorf("strict start with an unwatchable detectiondir exited with %d: %s", code, out)
+	}
+
+	addr := freeAddress(t)
+	startMain(t, "-config.file", writeConfig(t, conf), "-web.listen-address", addr)
+	if err := waitHealthy(addr, 10*time.Second); err != nil {
+		t.Fatalf("lenient start with an unwatchable detectiondir not serving: %s", err)
+	}
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `mail_detection_watch_up{configname="unwatchable"} 0`) {
+		t.Errorf("unwatchable detectiondir not exported as such in\n%s", body)
+	}
+}
+
+func TestConfigDirectoryMerged(t *testing.T) {
+	first, second := newSMTPStub(t), newSMTPStub(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"10-global.conf": "startupoffset: 0s\n" + stubConfig(first, "first"),
+		// settings of later files override earlier ones, servers are added to theirs
+		"20-team.conf": "mailchecktimeout: 10s\nservers:\n" + stubServer(second, "second"),
+		"README":       "not a config file\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addr := freeAddress(t)
+	startMain(t, "-config.file", dir, "-web.listen-address", addr)
+	if err := waitHealthy(addr, 10*time.Second); err != nil {
+		t.Fatalf("HTTP-endpoint not reachable: %s", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		firstOk := strings.Contains(string(body), "\nmail_deliver_success{configname=\"first\"} 1\n")
+		secondOk := strings.Contains(string(body), "\nmail_deliver_success{configname=\"second\"} 1\n")
+		timeout := strings.Contains(string(body), "\nmail_config_timeout_seconds{configname=\"first\"} 10\n")
+		if firstOk && secondOk && timeout {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want both servers delivering with the timeout of the later file, got first %t, second %t, timeout %t in\n%s", firstOk, secondOk, timeout, body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// histogramOf returns the sample count and sum of the histogram of the named config in h.
+func histogramOf(t *testing.T, h *prometheus.HistogramVec, name string) (uint64, float64) {
+	t.Helper()
+	r := prometheus.NewRegistry()
+	r.MustRegister(h)
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "configname" && l.GetValue() == name {
+					return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+				}
+			}
+		}
+	}
+	return 0, 0
+}
+
+func TestBuildInfo(t *testing.T) {
+	r := prometheus.NewRegistry()
+	registerMetrics(r)
+
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "mailexporter_build_info" {
+			continue
+		}
+
+		labels := map[string]string{}
+		for _, l := range f.GetMetric()[0].GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if len(labels) != 3 || labels["version"] != buildVersion || labels["revision"] != buildRevision || labels["goversion"] != runtime.Version() {
+			t.Errorf("unexpected labels %v", labels)
+		}
+		if v := f.GetMetric()[0].GetGauge().GetValue(); v != 1 {
+			t.Errorf("value %g, want 1", v)
+		}
+		return
+	}
+	t.Error("mailexporter_build_info not registered")
+}
+
+// recordingRegisterer registers into a registry and remembers all collectors registered.
+type recordingRegisterer struct {
+	*prometheus.Registry
+	collectors []prometheus.Collector
+}
+
+func (r *recordingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	r.collectors = append(r.collectors, cs...)
+	r.Registry.MustRegister(cs...)
+}
+
+func TestSeriesExportedBeforeFirstProbe(t *testing.T) {
+	resetConfig(t)
+	r := &recordingRegisterer{Registry: prometheus.NewRegistry()}
+	registerMetrics(r)
+	c := smtpServerConfig{
+		Name: "unprobed",
+		From: []string{"probe@example.com"},
+		SLOs: []sloConfig{{Percentile: 99, Threshold: time.Minute}},
+	}
+	initMetrics(c)
+	initStatus(c.Name)
+
+	// all metrics labeled by configname, whether they have any series yet or not
+	labeledBy := regexp.MustCompile(`fqName: "([^"]+)".*variableLabels: \[[^\]]*\bconfigname\b`)
+	perConfig := map[string]bool{}
+	for _, collector := range r.collectors {
+		descs := make(chan *prometheus.Desc, 16)
+		go func() {
+			collector.Describe(descs)
+			close(descs)
+		}()
+		for d := range descs {
+			if m := labeledBy.FindStringSubmatch(d.String()); m != nil {
+				perConfig[m[1]] = false
+			}
+		}
+	}
+	if len(perConfig) == 0 {
+		t.Fatal("no per-config metrics registered")
+	}
+	// set up along with the filesystem-watcher, which is before serving as well
+	delete(perConfig, "mail_detection_watch_up")
+
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "configname" && l.GetValue() == c.Name {
+					perConfig[f.GetName()] = true
+				}
+			}
+		}
+	}
+	for name, exported := range perConfig {
+		if !exported {
+			t.Errorf("%s not exported for a config not probed yet", name)
+		}
+	}
+
+	if v := testutil.ToFloat64(deliverOk.WithLabelValues(c.Name)); v != 0 {
+		t.Errorf("deliver_ok %g before the first probe, want 0", v)
+	}
+	if v := testutil.ToFloat64(deliverDurationGauge.WithLabelValues(c.Name)); !math.IsNaN(v) {
+		t.Errorf("last deliver duration %g before the first probe, want NaN", v)
+	}
+}
+
+func TestConfiguredTimingsExported(t *testing.T) {
+	resetConfig(t)
+	content := `monitoringinterval: 2m
+mailchecktimeout: 30s
+servers:
+    - name: defaults
+      server: smtp.example.com
+      port: 25
+      from: probe@example.com
+      to: probe@example.com
+      detectiondir: /tmp
+    - name: overridden
+      server: smtp.example.com
+      port: 25
+      from: probe@example.com
+      to: probe@example.com
+      detectiondir: /tmp
+      interval: 5m
+      mailchecktimeout: 90s
+`
+	if err := parseConfig([]string{writeConfig(t, content)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range globalconf.Servers {
+		initMetrics(c)
+	}
+
+	for name, want := range map[string][2]float64{"defaults": {30, 120}, "overridden": {90, 300}} {
+		if v := testutil.ToFloat64(configTimeout.WithLabelValues(name)); v != want[0] {
+			t.Errorf("configured timeout of %s exported as %g, want %g", name, v, want[0])
+		}
+		if v := testutil.ToFloat64(configInterval.WithLabelValues(name)); v != want[1] {
+			t.Errorf("configured interval of %s exported as %g, want %g", name, v, want[1])
+		}
+	}
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	r := prometheus.NewRegistry()
+	registerMetrics(r)
+
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, f := range families {
+		found[strings.SplitN(f.GetName(), "_", 2)[0]] = true
+	}
+	for _, prefix := range []string{"go", "process"} {
+		if !found[prefix] {
+			t.Errorf("no %s_ metrics registered", prefix)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	r := prometheus.NewRegistry()
+	registerMetrics(r)
+	deliverOk.WithLabelValues("handler-test").Set(1)
+	t.Cleanup(func() { deliverOk.DeleteLabelValues("handler-test") })
+
+	rec := httptest.NewRecorder()
+	newMetricsHandler(r).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q, want the text format", ct)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	for _, line := range []string{
+		"# TYPE mail_deliver_success gauge",
+		`mail_deliver_success{configname="handler-test"} 1`,
+		"# TYPE mailexporter_up gauge",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("line %q missing from\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsGzipped(t *testing.T) {
+	r := prometheus.NewRegistry()
+	registerMetrics(r)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	newMetricsHandler(r).ServeHTTP(rec, req)
+
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", enc)
+	}
+	body, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(metrics), "# TYPE mailexporter_up gauge\n") {
+		t.Errorf("unexpected metrics after decompression:\n%s", metrics)
+	}
+}
+
+func TestExemplarsCarryToken(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "exemplar")
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	messages := stub.receivedMessages(t)
+	if len(messages) != 1 {
+		t.Fatalf("%d messages received, want 1", len(messages))
+	}
+	body, _ := io.ReadAll(messages[0].Body)
+	p, err := decomposePayload(bytes.TrimSpace(body))
+	if err != nil {
+		t.Fatalf("no payload in %q: %s", body, err)
+	}
+
+	r := prometheus.NewRegistry()
+	r.MustRegister(sendDurationHist, deliverDurationHist)
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	rec := httptest.NewRecorder()
+	newMetricsHandler(r).ServeHTTP(rec, req)
+	metrics, _ := io.ReadAll(rec.Body)
+
+	for _, name := range []string{"mail_send_durations_seconds", "mail_deliver_durations_seconds"} {
+		exemplar := regexp.MustCompile(name + `_bucket\{configname="exemplar",le="[^"]+"\} [0-9]+ # \{token="` + p.token + `"\} [0-9.e-]+`)
+		if !exemplar.Match(metrics) {
+			t.Errorf("no exemplar of token %s in %s of\n%s", p.token, name, metrics)
+		}
+	}
+}
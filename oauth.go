@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"smtp"
+)
+
+// oauthRefreshMargin is how long before its expiry a token from an endpoint is refreshed.
+const oauthRefreshMargin = time.Minute
+
+// oauthClient fetches tokens from OAuthTokenURL.
+var oauthClient = &http.Client{Timeout: 30 * time.Second}
+
+// xoauth2Auth implements the XOAUTH2 SASL-mechanism for user with tokens from tokens.
+type xoauth2Auth struct {
+	user   string
+	tokens *oauthTokenSource
+}
+
+func (a xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// the bearer token must not be sent in the clear, same as PlainAuth's passphrase,
+	// unless to a local server, e.g. one reached via its Unix domain socket
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	token, err := a.tokens.token()
+	if err != nil {
+		return "", nil, fmt.Errorf("fetching oauth token: %s", err)
+	}
+	return "XOAUTH2", []byte("user=" + a.user + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+// isLocalhost tells if name is the local host, which PlainAuth trusts without TLS as well.
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+func (a xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sends its error details as challenge and awaits an empty
+		// response before failing the exchange with the actual error reply
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// oauthTokenSource provides a static token or caches the ones fetched from an endpoint
+// via the client-credentials grant until shortly before they expire.
+type oauthTokenSource struct {
+	c smtpServerConfig
+
+	mu      sync.Mutex
+	current string
+	expiry  time.Time
+}
+
+var (
+	oauthSourcesMu sync.Mutex
+	oauthSources   = make(map[string]*oauthTokenSource)
+)
+
+// oauthTokens returns the token source of config c, shared by all of its probes.
+func oauthTokens(c smtpServerConfig) *oauthTokenSource {
+	oauthSourcesMu.Lock()
+	defer oauthSourcesMu.Unlock()
+
+	s, ok := oauthSources[c.Name]
+	if !ok {
+		s = &oauthTokenSource{c: c}
+		oauthSources[c.Name] = s
+	}
+	return s
+}
+
+func (s *oauthTokenSource) token() (string, error) {
+	if s.c.OAuthToken != "" {
+		return s.c.OAuthToken, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != "" && time.Now().Add(oauthRefreshMargin).Before(s.expiry) {
+		return s.current, nil
+	}
+
+	token, expiry, err := fetchOAuthToken(s.c)
+	if err != nil {
+		return "", err
+	}
+	s.current, s.expiry = token, expiry
+	return token, nil
+}
+
+// fetchOAuthToken requests a token for config c from its OAuthTokenURL, returning it with its expiry.
+func fetchOAuthToken(c smtpServerConfig) (string, time.Time, error) {
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {c.OAuthClientID},
+		"client_secret": {c.OAuthClientSecret},
+	}
+	if len(c.OAuthScopes) > 0 {
+		form.Set("scope", strings.Join(c.OAuthScopes, " "))
+	}
+
+	requested := time.Now()
+	resp, err := oauthClient.PostForm(c.OAuthTokenURL, form)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", time.Time{}, err
+	}
+	if body.AccessToken == "" {
+		return "", time.Time{}, errors.New("token endpoint returned no access_token")
+	}
+
+	return body.AccessToken, requested.Add(time.Duration(body.ExpiresIn) * time.Second), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"smtp"
+)
+
+// xoauth2Blob returns the decoded initial response of the XOAUTH2-authentication stub received.
+func xoauth2Blob(t *testing.T, stub *smtpStub) string {
+	t.Helper()
+	for _, cmd := range stub.received() {
+		if blob, ok := strings.CutPrefix(cmd, "AUTH XOAUTH2 "); ok {
+			decoded, err := base64.StdEncoding.DecodeString(blob)
+			if err != nil {
+				t.Fatalf("initial response %q not base64: %s", blob, err)
+			}
+			return string(decoded)
+		}
+	}
+	t.Fatalf("no XOAUTH2-authentication in %q", stub.received())
+	return ""
+}
+
+func TestXOAUTH2(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t)
+	stub := newSMTPStub(t, func(s *smtpStub) {
+		s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+		s.auth = "XOAUTH2"
+	})
+	t.Cleanup(func() { delete(oauthSources, "xoauth2") })
+
+	c := probeConfig(t, stub, "xoauth2", "cafile: "+ca.file, "authmechanism: xoauth2", "login: probe@example.com", "oauthtoken: static-token")
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe authenticating via XOAUTH2 failed: %s", r.Error)
+	}
+	if blob, want := xoauth2Blob(t, stub), "user=probe@example.com\x01auth=Bearer static-token\x01\x01"; blob != want {
+		t.Errorf("initial response %q, want %q", blob, want)
+	}
+}
+
+func TestXOAUTH2ViaUnixSocket(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "fetched-token", "expires_in": 3600}`))
+	}))
+	t.Cleanup(endpoint.Close)
+	// the local MTA's socket is as trustworthy as the loopback, so no TLS is needed
+	stub := listenSMTPStub(t, "unix", filepath.Join(t.TempDir(), "smtp.sock"), func(s *smtpStub) { s.auth = "XOAUTH2" })
+	t.Cleanup(func() { delete(oauthSources, "xoauth2-socket") })
+
+	c := probeConfig(t, stub, "xoauth2-socket", "authmechanism: xoauth2", "login: probe@example.com", "oauthtokenurl: "+endpoint.URL, "oauthclientid: probe")
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe authenticating via XOAUTH2 over a unix domain socket failed: %s", r.Error)
+	}
+	if blob, want := xoauth2Blob(t, stub), "user=probe@example.com\x01auth=Bearer fetched-token\x01\x01"; blob != want {
+		t.Errorf("initial response %q, want %q", blob, want)
+	}
+}
+
+func TestXOAUTH2RequiresTLS(t *testing.T) {
+	a := xoauth2Auth{"probe@example.com", &oauthTokenSource{c: smtpServerConfig{OAuthToken: "secret"}}}
+	if _, resp, err := a.Start(&smtp.ServerInfo{Name: "relay.example.com", TLS: false}); err == nil {
+		t.Errorf("token %q sent to a remote server unencrypted", resp)
+	}
+	for _, name := range []string{"relay.example.com", "localhost"} {
+		if _, _, err := a.Start(&smtp.ServerInfo{Name: name, TLS: name == "relay.example.com"}); err != nil {
+			t.Errorf("token not sent to %s: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMsgIdIndependentOfPayloadFormat(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadFormat = "json"
+	globalconf.PayloadSeparator = "-"
+
+	c := smtpServerConfig{Name: "mail \"one\""}
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		p, err := newPayload(c.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := createMsgId(c, "probe@example.com", p)
+		// a msg-id is an addr-spec in angle brackets
+		if _, err := mail.ParseAddress("<" + id + ">"); err != nil {
+			t.Errorf("invalid Message-ID %q: %s", id, err)
+		}
+		if seen[id] {
+			t.Errorf("Message-ID %q repeated", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestMsgIdDomain(t *testing.T) {
+	resetConfig(t)
+	p := payload{token: "abc", timestamp: 42, configname: "x"}
+
+	c := smtpServerConfig{}
+	if id := createMsgId(c, "probe@example.com", p); id != "abc.42@example.com" {
+		t.Errorf("got %q, want the sender's domain", id)
+	}
+	c.MessageIDDomain = "probes.example.org"
+	if id := createMsgId(c, "probe@example.com", p); id != "abc.42@probes.example.org" {
+		t.Errorf("got %q, want the configured domain", id)
+	}
+}
+
+func TestPaddingWholeLines(t *testing.T) {
+	for n := 0; n < 3*(paddingLineLength+2); n++ {
+		p := padding(n)
+		if len(p) != n && !(len(p) == n+1 && strings.HasSuffix(p, "\r\n")) {
+			t.Errorf("padding(%d) is %d bytes long", n, len(p))
+		}
+		if strings.Count(p, "\r") != strings.Count(p, "\r\n") || strings.Count(p, "\n") != strings.Count(p, "\r\n") {
+			t.Errorf("padding(%d) contains bare line breaks: %q", n, p)
+		}
+	}
+}
+
+func TestPayloadVersions(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadSeparator = "-"
+	p := payload{token: "abc", timestamp: 1700000000000000000, configname: "versioned"}
+
+	for _, format := range []string{"delimited", "json"} {
+		globalconf.PayloadFormat = format
+		encoded := p.String()
+		if !strings.HasPrefix(encoded, "v1-") && !strings.Contains(encoded, `"version":"v1"`) {
+			t.Errorf("%s payload %q not tagged v1", format, encoded)
+		}
+		got, err := decomposePayload([]byte(encoded))
+		if err != nil {
+			t.Errorf("%s payload %q not decomposed: %s", format, encoded, err)
+		} else if got != p {
+			t.Errorf("%s payload decomposed into %+v, want %+v", format, got, p)
+		}
+	}
+
+	for _, unknown := range []string{
+		"v2-abc-1700000000000000000-versioned",
+		`{"version":"v2","name":"versioned","token":"abc","sent":1700000000000000000}`,
+		"abc-1700000000000000000-versioned",
+	} {
+		if _, err := decomposePayload([]byte(unknown)); err != errNotOurDept {
+			t.Errorf("payload %q of an unknown version gave %v, want %v", unknown, err, errNotOurDept)
+		}
+	}
+}
+
+func TestSignedPayloads(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadSeparator = "-"
+	globalconf.PayloadSecret = "shared secret"
+	p := payload{token: "abc", timestamp: 1700000000000000000, configname: "signed"}
+
+	for _, format := range []string{"delimited", "json"} {
+		globalconf.PayloadFormat = format
+		signed := p.String()
+		got, err := decomposePayload([]byte(signed))
+		if err != nil {
+			t.Errorf("validly signed %s payload %q rejected: %s", format, signed, err)
+		} else if got != p {
+			t.Errorf("%s payload decomposed into %+v, want %+v", format, got, p)
+		}
+
+		tampered := strings.Replace(signed, "abc", "abd", 1)
+		if _, err := decomposePayload([]byte(tampered)); err != errNotOurDept {
+			t.Errorf("tampered %s payload %q gave %v, want %v", format, tampered, err, errNotOurDept)
+		}
+		unsigned := signed[:strings.LastIndex(signed, "-")]
+		if _, err := decomposePayload([]byte(unsigned)); err != errNotOurDept {
+			t.Errorf("unsigned %s payload %q gave %v, want %v", format, unsigned, err, errNotOurDept)
+		}
+	}
+
+	// signed by someone else
+	signed := signPayload("v1-abc-1700000000000000000-signed")
+	globalconf.PayloadSecret = "other secret"
+	if _, err := verifyPayload(signed); err != errNotOurDept {
+		t.Errorf("payload signed with another secret gave %v, want %v", err, errNotOurDept)
+	}
+}
+
+func TestPayloadSeparators(t *testing.T) {
+	resetConfig(t)
+	globalconf.PayloadFormat = "delimited"
+
+	for _, sep := range []string{"|", "#~", "_"} {
+		for _, secret := range []string{"", "shared secret"} {
+			globalconf.PayloadSeparator = sep
+			globalconf.PayloadSecret = secret
+			p, err := newPayload("edge-relay")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encoded := p.String()
+			if !strings.HasPrefix(encoded, "v1"+sep+p.token+sep) {
+				t.Errorf("payload %q not separated by %q", encoded, sep)
+			}
+			got, err := decomposePayload([]byte(encoded))
+			if err != nil {
+				t.Errorf("payload %q separated by %q not decomposed: %s", encoded, sep, err)
+			} else if got != p {
+				t.Errorf("payload %q separated by %q decomposed into %+v, want %+v", encoded, sep, got, p)
+			}
+
+			// not taken for one of ours once the separator changed
+			globalconf.PayloadSeparator = "="
+			if _, err := decomposePayload([]byte(encoded)); err != errNotOurDept {
+				t.Errorf("payload %q separated by %q decomposed with separator %q", encoded, sep, globalconf.PayloadSeparator)
+			}
+		}
+	}
+}
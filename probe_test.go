@@ -0,0 +1,1004 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProbeDelivers(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "deliver")
+	// metrics are global, so only their change is judged
+	succeeded := testutil.ToFloat64(probesSucceeded.WithLabelValues(c.Name))
+	timedOut := testutil.ToFloat64(probesTimedOut.WithLabelValues(c.Name))
+
+	r := probe(context.Background(), c)
+	if !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	if v := testutil.ToFloat64(deliverOk.WithLabelValues(c.Name)); v != 1 {
+		t.Errorf("deliver_ok %g after delivery, want 1", v)
+	}
+	if v := testutil.ToFloat64(probesSucceeded.WithLabelValues(c.Name)) - succeeded; v != 1 {
+		t.Errorf("%g probes succeeded, want 1", v)
+	}
+	if v := testutil.ToFloat64(probesTimedOut.WithLabelValues(c.Name)) - timedOut; v != 0 {
+		t.Errorf("%g probes timed out, want none", v)
+	}
+}
+
+func TestProbeTimesOut(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.drop = true })
+	c := probeConfig(t, stub, "timeout", "mailchecktimeout: 200ms")
+	timedOut := testutil.ToFloat64(probesTimedOut.WithLabelValues(c.Name))
+	succeeded := testutil.ToFloat64(probesSucceeded.WithLabelValues(c.Name))
+
+	start := time.Now()
+	r := probe(context.Background(), c)
+	if r.Success || r.Error != errDeliverTimeout.Error() {
+		t.Fatalf("probe of dropped mail ended with %+v, want timeout", r)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("probe took %s to time out after 200ms", d)
+	}
+	if v := testutil.ToFloat64(deliverOk.WithLabelValues(c.Name)); v != 0 {
+		t.Errorf("deliver_ok %g after timeout, want 0", v)
+	}
+	if v := testutil.ToFloat64(probesTimedOut.WithLabelValues(c.Name)) - timedOut; v != 1 {
+		t.Errorf("%g probes timed out, want 1", v)
+	}
+	if v := testutil.ToFloat64(probesSucceeded.WithLabelValues(c.Name)) - succeeded; v != 0 {
+		t.Errorf("%g probes succeeded, want none", v)
+	}
+}
+
+func TestPooledConnectionOutlivesProbe(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "reuse", "reuseconnection: true")
+	t.Cleanup(func() {
+		pooledConns.Lock()
+		pooledConns.drained = false
+		pooledConns.Unlock()
+	})
+
+	for i := 0; i < 2; i++ {
+		// cancelled once the probe is done, as the context of a /probe-request is
+		ctx, cancel := context.WithCancel(context.Background())
+		r := probe(ctx, c)
+		cancel()
+		if !r.Success {
+			t.Fatalf("probe %d failed: %s", i, r.Error)
+		}
+	}
+	if n := stub.connections(); n != 1 {
+		t.Errorf("%d connections for two probes, want 1", n)
+	}
+
+	stub.hangUp()
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe after the server closed the pooled connection failed: %s", r.Error)
+	}
+	if n := stub.connections(); n != 2 {
+		t.Errorf("%d connections after the server closed the first, want 2", n)
+	}
+
+	drainPooledConns()
+	// the stub records QUIT before answering it
+	if commands := stub.received(); commands[len(commands)-1] != "QUIT" {
+		t.Errorf("pooled connection not ended with QUIT on shutdown, got %q", commands)
+	}
+}
+
+func TestRateLimitedProbeSendsNothing(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "ratelimited", "maxsendsperminute: 1")
+	t.Cleanup(func() { delete(sendBudgets.configs, c.Name) })
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("first probe failed: %s", r.Error)
+	}
+	if r := probe(context.Background(), c); r.Error != errRateLimited.Error() {
+		t.Fatalf("second probe within a minute ended with %+v, want it rate limited", r)
+	}
+	if n := stub.connections(); n != 1 {
+		t.Errorf("%d connections, want only the first probe's", n)
+	}
+}
+
+func TestTokenFailureSendsNothing(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "tokenfailure")
+	failures := testutil.ToFloat64(tokenGenerationFailures.WithLabelValues(c.Name))
+
+	tokenRand = iotest.ErrReader(errors.New("entropy exhausted"))
+	t.Cleanup(func() { tokenRand = crand.Reader })
+
+	if r := probe(context.Background(), c); r.Success || !strings.Contains(r.Error, "entropy exhausted") {
+		t.Fatalf("probe without randomness ended with %+v, want it failed on the token", r)
+	}
+	if d := testutil.ToFloat64(tokenGenerationFailures.WithLabelValues(c.Name)) - failures; d != 1 {
+		t.Errorf("token generation failures increased by %g, want 1", d)
+	}
+	if n := stub.connections(); n != 0 {
+		t.Errorf("%d connections, want none without a token", n)
+	}
+}
+
+func TestTimeoutDuringFloodOfForeignMails(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.drop = true })
+	c := probeConfig(t, stub, "flooded", "mailchecktimeout: 300ms")
+	early := testutil.ToFloat64(earlyMails.WithLabelValues(c.Name))
+
+	// mails of the config, but none of the probe
+	flooding := make(chan struct{})
+	flooded := make(chan struct{})
+	go func() {
+		defer close(flooded)
+		for i := 0; ; i++ {
+			select {
+			case <-flooding:
+				return
+			default:
+			}
+			p, err := newPayload(c.Name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			path := filepath.Join(stub.maildir, "new", fmt.Sprintf("flood.%d", i))
+			if err := os.WriteFile(path, []byte("Subject: probe\r\n\r\n"+p.String()), 0600); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(flooding)
+		<-flooded
+	}()
+
+	start := time.Now()
+	r := probe(context.Background(), c)
+	if r.Success || r.Error != errDeliverTimeout.Error() {
+		t.Fatalf("probe ended with %+v, want it timed out", r)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("probe timed out after %s, want about 300ms", d)
+	}
+	if v := testutil.ToFloat64(earlyMails.WithLabelValues(c.Name)) - early; v == 0 {
+		t.Error("no foreign mails detected during the probe")
+	}
+}
+
+func TestDetectionNotBlockedByBusyProbe(t *testing.T) {
+	stub := newSMTPStub(t)
+	servers := detectConfig(t, stubConfig(stub, "busy")+stubServer(stub, "responsive"))
+	dropped := testutil.ToFloat64(reportsDropped.WithLabelValues("busy"))
+
+	// a probe of busy waiting for its mail, but not receiving reports at the moment
+	p, err := newPayload("busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	announceToken(registration{p.token, make(chan email)})
+	defer releaseToken(p.token)
+	if err := stub.deliver([]byte("Subject: probe\r\n\r\n" + p.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := probe(context.Background(), servers[1]); !r.Success {
+		t.Fatalf("probe of another server failed while one was busy: %s", r.Error)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(reportsDropped.WithLabelValues("busy"))-dropped != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("mail of the busy probe never dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendTimeoutDuringData(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.dataDelay = 2 * time.Second })
+	c := probeConfig(t, stub, "stalling")
+	globalconf.SendTimeout = 200 * time.Millisecond
+	timeouts := testutil.ToFloat64(mailSendErrors.WithLabelValues(c.Name, "timeout"))
+
+	start := time.Now()
+	if r := probe(context.Background(), c); r.Success {
+		t.Fatal("probe succeeded against a server stalling after the data")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("send aborted after %s, want it near the send timeout", d)
+	}
+	if d := testutil.ToFloat64(mailSendErrors.WithLabelValues(c.Name, "timeout")) - timeouts; d != 1 {
+		t.Errorf("timeout send errors increased by %g, want 1", d)
+	}
+}
+
+func TestSendCancelledDuringData(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.dataDelay = 2 * time.Second })
+	c := probeConfig(t, stub, "cancelled")
+	p, err := newPayload(c.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- send(ctx, c, c.From[0], c.To[0], p) }()
+
+	// wait for the server to sit on the data
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stub.received()) == 0 || stub.received()[len(stub.received())-1] != "DATA" {
+		if time.Now().After(deadline) {
+			t.Fatalf("data never sent: %q", stub.received())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("send cancelled mid-conversation returned %v, want %v", err, context.Canceled)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("send returned %s after being cancelled", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send not aborted when cancelled")
+	}
+}
+
+func TestSendErrorsClassified(t *testing.T) {
+	untrusted := newTestCA(t).issue(t)
+	for _, tc := range []struct {
+		name      string
+		configure func(*smtpStub)
+		server    []string
+		reason    string
+		// connections made with one retry of transient errors
+		attempts int
+	}{
+		{"greeting-rejected", func(s *smtpStub) { s.greeting = "554 no service for you" }, nil, "5xx", 1},
+		{"greeting-busy", func(s *smtpStub) { s.greeting = "421 too busy" }, nil, "4xx", 2},
+		{"tls-untrusted", func(s *smtpStub) { s.tls = &tls.Config{Certificates: []tls.Certificate{untrusted}} }, nil, "tls", 1},
+		{"auth-rejected", func(s *smtpStub) { s.auth, s.rejectAuth = "PLAIN", true }, []string{"login: probe", "passphrase: wrong"}, "auth", 1},
+		{"auth-unsupported", nil, []string{"login: probe", "passphrase: secret"}, "auth", 1},
+		{"rcpt-rejected", func(s *smtpStub) { s.rcptReply = "550 no such user" }, nil, "5xx", 1},
+		{"rcpt-deferred", func(s *smtpStub) { s.rcptReply = "450 mailbox busy" }, nil, "4xx", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var configure []func(*smtpStub)
+			if tc.configure != nil {
+				configure = append(configure, tc.configure)
+			}
+			stub := newSMTPStub(t, configure...)
+			c := detectConfig(t, "sendretries: 1\nsendretrybackoff: 10ms\n"+stubConfig(stub, tc.name, tc.server...))[0]
+			errs := testutil.ToFloat64(mailSendErrors.WithLabelValues(c.Name, tc.reason))
+
+			if r := probe(context.Background(), c); r.Success {
+				t.Fatal("probe succeeded")
+			}
+			if v := testutil.ToFloat64(mailSendErrors.WithLabelValues(c.Name, tc.reason)) - errs; v != 1 {
+				t.Errorf("%g send errors for reason %s, want 1", v, tc.reason)
+			}
+			if n := stub.connections(); n != tc.attempts {
+				t.Errorf("%d connections made, want %d", n, tc.attempts)
+			}
+		})
+	}
+}
+
+func TestTransientErrorsRetried(t *testing.T) {
+	for _, tc := range []struct {
+		busy, retries int
+		success       bool
+		// least time taken by the backoffs of 100ms, doubled per retry
+		backoff time.Duration
+	}{
+		{busy: 1, retries: 1, success: true, backoff: 100 * time.Millisecond},
+		{busy: 2, retries: 2, success: true, backoff: 300 * time.Millisecond},
+		{busy: 2, retries: 1, success: false, backoff: 100 * time.Millisecond},
+	} {
+		t.Run(fmt.Sprintf("busy%d-retries%d", tc.busy, tc.retries), func(t *testing.T) {
+			stub := newSMTPStub(t, func(s *smtpStub) { s.busyConns = tc.busy })
+			c := detectConfig(t, fmt.Sprintf("sendretries: %d\nsendretrybackoff: 100ms\n", tc.retries)+stubConfig(stub, "retried"))[0]
+
+			begin := time.Now()
+			r := probe(context.Background(), c)
+			if r.Success != tc.success {
+				t.Fatalf("probe succeeded: %t, want %t: %s", r.Success, tc.success, r.Error)
+			}
+			if took := time.Since(begin); took < tc.backoff {
+				t.Errorf("probe took %s, less than the backoff of %s", took, tc.backoff)
+			}
+			if n, want := stub.connections(), min(tc.busy, tc.retries)+1; n != want {
+				t.Errorf("%d connections made, want %d", n, want)
+			}
+			if n := len(stub.receivedMessages(t)); (n == 1) != tc.success {
+				t.Errorf("%d mails handed over", n)
+			}
+		})
+	}
+}
+
+func TestSendersRotated(t *testing.T) {
+	stub := newSMTPStub(t)
+	content := strings.Replace(stubConfig(stub, "rotated"), "from: probe@example.com", "from: [probe@example.com, probe@example.org]", 1)
+	c := detectConfig(t, content)[0]
+	t.Cleanup(func() {
+		senderRotation.Lock()
+		defer senderRotation.Unlock()
+		delete(senderRotation.next, c.Name)
+	})
+
+	want := []string{"probe@example.com", "probe@example.org", "probe@example.com"}
+	for i, sender := range want {
+		if r := probe(context.Background(), c); !r.Success {
+			t.Fatalf("probe %d failed: %s", i, r.Error)
+		}
+		if v := testutil.ToFloat64(senderDeliverOk.WithLabelValues(c.Name, sender)); v != 1 {
+			t.Errorf("mail_sender_deliver_success of %s %g after probe %d, want 1", sender, v, i)
+		}
+	}
+
+	var envelope []string
+	for _, cmd := range stub.received() {
+		if from, ok := strings.CutPrefix(cmd, "MAIL FROM:"); ok {
+			envelope = append(envelope, strings.Fields(from)[0])
+		}
+	}
+	messages := stub.receivedMessages(t)
+	if len(envelope) != len(want) || len(messages) != len(want) {
+		t.Fatalf("%d envelopes and %d messages received, want %d", len(envelope), len(messages), len(want))
+	}
+	for i, sender := range want {
+		if envelope[i] != "<"+sender+">" {
+			t.Errorf("probe %d sent from %s, want %s", i, envelope[i], sender)
+		}
+		if from := messages[i].Header.Get("From"); from != sender {
+			t.Errorf("From-header %q of probe %d, want %s", from, i, sender)
+		}
+		if id := messages[i].Header.Get("Message-Id"); !strings.HasSuffix(id, "@"+strings.Split(sender, "@")[1]+">") {
+			t.Errorf("Message-Id %q of probe %d not of the domain of %s", id, i, sender)
+		}
+	}
+}
+
+// panickingReader panics on its first read and reads from r afterwards.
+type panickingReader struct {
+	r        io.Reader
+	panicked atomic.Bool
+}
+
+func (p *panickingReader) Read(b []byte) (int, error) {
+	if p.panicked.CompareAndSwap(false, true) {
+		panic("injected")
+	}
+	return p.r.Read(b)
+}
+
+func TestMaxConcurrentProbes(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.dataDelay = 50 * time.Millisecond })
+	content := "maxconcurrentprobes: 2\n" + stubConfig(stub, "limited0")
+	for i := 1; i < 6; i++ {
+		content += stubServer(stub, fmt.Sprintf("limited%d", i))
+	}
+	servers := detectConfig(t, content)
+	probeSlots = make(chan struct{}, globalconf.MaxConcurrentProbes)
+	t.Cleanup(func() { probeSlots = nil })
+
+	var probes sync.WaitGroup
+	for _, c := range servers {
+		probes.Add(1)
+		go func(c smtpServerConfig) {
+			defer probes.Done()
+			if r := probe(context.Background(), c); !r.Success {
+				t.Errorf("probe of %s failed: %s", c.Name, r.Error)
+			}
+		}(c)
+	}
+	probes.Wait()
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.mostAccepting != 2 {
+		t.Errorf("%d probes sent at once, want 2", stub.mostAccepting)
+	}
+}
+
+func TestIntervalOverride(t *testing.T) {
+	stub := newSMTPStub(t)
+	content := "startupoffset: 0s\n" + strings.Replace(stubConfig(stub, "fast", "interval: 100ms"), "monitoringinterval: 1m", "monitoringinterval: 1h", 1) + stubServer(stub, "slow")
+	servers := detectConfig(t, content)
+	fast := testutil.ToFloat64(probesSucceeded.WithLabelValues("fast"))
+	slow := testutil.ToFloat64(probesStarted.WithLabelValues("slow"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var monitors sync.WaitGroup
+	defer func() {
+		cancel()
+		monitors.Wait()
+	}()
+	begin := time.Now()
+	for i, c := range servers {
+		monitors.Add(1)
+		go func(c smtpServerConfig, index int) {
+			defer monitors.Done()
+			monitor(ctx, c, index)
+		}(c, i)
+	}
+
+	deadline := begin.Add(5 * time.Second)
+	for testutil.ToFloat64(probesSucceeded.WithLabelValues("fast"))-fast < 4 {
+		if time.Now().After(deadline) {
+			t.Fatal("server with an interval of 100ms not probed four times")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if took := time.Since(begin); took < 300*time.Millisecond {
+		t.Errorf("four probes within %s at an interval of 100ms", took)
+	}
+	if v := testutil.ToFloat64(probesStarted.WithLabelValues("slow")) - slow; v != 1 {
+		t.Errorf("server at the global interval of 1h probed %g times, want once", v)
+	}
+}
+
+func TestIntervalJitter(t *testing.T) {
+	resetConfig(t)
+	if d := jitter(time.Minute); d != time.Minute {
+		t.Errorf("interval without jitter varied to %s", d)
+	}
+
+	globalconf.IntervalJitter = 0.2
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 1000; i++ {
+		d := jitter(time.Minute)
+		if d < 48*time.Second || d > 72*time.Second {
+			t.Fatalf("interval of 1m varied to %s by a jitter of 20%%", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 100 {
+		t.Errorf("only %d different intervals of 1000", len(seen))
+	}
+}
+
+func TestMonitorContinuesAfterPanic(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "panicking", "interval: 500ms")
+	globalconf.StartupOffset = new(time.Duration)
+	panics := testutil.ToFloat64(monitorPanics.WithLabelValues(c.Name))
+	succeeded := testutil.ToFloat64(probesSucceeded.WithLabelValues(c.Name))
+
+	tokenRand = &panickingReader{r: crand.Reader}
+	t.Cleanup(func() { tokenRand = crand.Reader })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		monitor(ctx, c, 0)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(probesSucceeded.WithLabelValues(c.Name)) == succeeded {
+		if time.Now().After(deadline) {
+			t.Fatal("no probe succeeded after the first panicked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := testutil.ToFloat64(monitorPanics.WithLabelValues(c.Name)) - panics; d != 1 {
+		t.Errorf("monitor panics increased by %g, want 1", d)
+	}
+}
+
+func TestConcurrentProbesAndScrapes(t *testing.T) {
+	stub := newSMTPStub(t)
+	content := "monitoringinterval: 1m\nmailchecktimeout: 5s\nstartupoffset: 0s\nservers:\n"
+	for i := 0; i < 4; i++ {
+		content += stubServer(stub, fmt.Sprintf("concurrent%d", i))
+	}
+	servers := detectConfig(t, content)
+	fakeClock(t, time.Now())
+	r := prometheus.NewRegistry()
+	registerMetrics(r)
+	handler := newMetricsHandler(r)
+
+	succeeded := make([]float64, len(servers))
+	for i, c := range servers {
+		succeeded[i] = testutil.ToFloat64(probesSucceeded.WithLabelValues(c.Name))
+	}
+
+	// every monitor probes once right away, alongside the probes fired here
+	ctx, cancel := context.WithCancel(context.Background())
+	var monitors, probes sync.WaitGroup
+	defer func() {
+		cancel()
+		monitors.Wait()
+	}()
+	for i, c := range servers {
+		monitors.Add(1)
+		go func(c smtpServerConfig, index int) {
+			defer monitors.Done()
+			monitor(ctx, c, index)
+		}(c, i)
+		probes.Add(1)
+		go func(c smtpServerConfig) {
+			defer probes.Done()
+			if r := probe(context.Background(), c); !r.Success {
+				t.Errorf("probe of %s failed: %s", c.Name, r.Error)
+			}
+		}(c)
+	}
+
+	scraping := make(chan struct{})
+	var scrapers sync.WaitGroup
+	defer func() {
+		close(scraping)
+		scrapers.Wait()
+	}()
+	for i := 0; i < 4; i++ {
+		scrapers.Add(1)
+		go func() {
+			defer scrapers.Done()
+			for {
+				select {
+				case <-scraping:
+					return
+				default:
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("scrape: status %d", rec.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	probes.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for i, c := range servers {
+		for testutil.ToFloat64(probesSucceeded.WithLabelValues(c.Name))-succeeded[i] < 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("probe of the monitor of %s never succeeded", c.Name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestConnectDuration(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.greetDelay = 100 * time.Millisecond })
+	c := probeConfig(t, stub, "connect")
+	count, sum := histogramOf(t, connectDurationHist, c.Name)
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	newCount, newSum := histogramOf(t, connectDurationHist, c.Name)
+	if newCount != count+1 {
+		t.Fatalf("%d connect durations observed, want 1", newCount-count)
+	}
+	if d := newSum - sum; d < 0.1 || d > 1 {
+		t.Errorf("connect took %gs against a server greeting after 100ms", d)
+	}
+}
+
+func TestProbeToTwoRecipients(t *testing.T) {
+	stub := newSMTPStub(t)
+	content := strings.Replace(stubConfig(stub, "recipients"), "to: probe@example.com", "to: [probe@example.com, alias@example.com]", 1)
+	c := detectConfig(t, content)[0]
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe to two recipients failed: %s", r.Error)
+	}
+	for _, rcpt := range []string{"RCPT TO:<probe@example.com>", "RCPT TO:<alias@example.com>"} {
+		if !slices.Contains(stub.received(), rcpt) {
+			t.Errorf("no %q in %q", rcpt, stub.received())
+		}
+	}
+
+	// each with a token of its own to be detected by
+	messages := stub.receivedMessages(t)
+	if len(messages) != 2 {
+		t.Fatalf("%d messages received, want 2", len(messages))
+	}
+	var bodies []string
+	for _, m := range messages {
+		body, _ := io.ReadAll(m.Body)
+		bodies = append(bodies, string(body))
+	}
+	if bodies[0] == bodies[1] {
+		t.Errorf("both recipients got the same payload %q", bodies[0])
+	}
+}
+
+func TestPayloadHeader(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := detectConfig(t, "payloadheader: true\n"+stubConfig(stub, "header"))[0]
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	messages := stub.receivedMessages(t)
+	if len(messages) != 1 {
+		t.Fatalf("%d messages received, want 1", len(messages))
+	}
+	header := messages[0].Header.Get(payloadHeader)
+	p, err := decomposePayload([]byte(header))
+	if err != nil || p.configname != c.Name {
+		t.Fatalf("no payload of %s in %s: %q", c.Name, payloadHeader, header)
+	}
+
+	// detected by the header alone if a gateway rewrote the body
+	path := filepath.Join(t.TempDir(), "rewritten")
+	rewritten := "Subject: probe\r\n" + payloadHeader + ": " + header + "\r\nContent-Type: text/html\r\n\r\n<html><body>converted</body></html>\r\n"
+	if err := os.WriteFile(path, []byte(rewritten), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := parseMail(path); err != nil || m.token != p.token {
+		t.Errorf("mail with the payload in the header only not detected: %v", err)
+	}
+}
+
+func TestSubjectRendered(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := detectConfig(t, "subject: \"probe of {{.Name}} [{{.Token}}]\"\n"+stubConfig(stub, "subject"))[0]
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	messages := stub.receivedMessages(t)
+	if len(messages) != 1 {
+		t.Fatalf("%d messages received, want 1", len(messages))
+	}
+	body, err := io.ReadAll(messages[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := decomposePayload(bytes.TrimSpace(body))
+	if err != nil {
+		t.Fatalf("no payload in %q: %s", body, err)
+	}
+	if subject := messages[0].Header.Get("Subject"); subject != "probe of subject ["+p.token+"]" {
+		t.Errorf("subject %q, want the name and token %s", subject, p.token)
+	}
+}
+
+func TestProbeStartsCounted(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "started")
+	clock := fakeClock(t, time.Unix(1700000000, 0))
+	started := testutil.ToFloat64(probesStarted.WithLabelValues(c.Name))
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	if v := testutil.ToFloat64(probesStarted.WithLabelValues(c.Name)); v != started+1 {
+		t.Errorf("%g probes counted as started, want 1", v-started)
+	}
+	if v := testutil.ToFloat64(lastProbeTime.WithLabelValues(c.Name)); v != 1700000000 {
+		t.Errorf("last probe at %g, want 1700000000", v)
+	}
+
+	// failing probes are counted just the same
+	*clock = clock.Add(time.Minute)
+	stub.ln.Close()
+	stub.hangUp()
+	if r := probe(context.Background(), c); r.Success {
+		t.Fatal("probe of a server gone succeeded")
+	}
+	if v := testutil.ToFloat64(probesStarted.WithLabelValues(c.Name)); v != started+2 {
+		t.Errorf("%g probes counted as started, want 2", v-started)
+	}
+	if v := testutil.ToFloat64(lastProbeTime.WithLabelValues(c.Name)); v != 1700000060 {
+		t.Errorf("last probe at %g, want 1700000060", v)
+	}
+}
+
+func TestMessageIDDomain(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "msgid", "messageiddomain: probes.example.org")
+
+	for i := 0; i < 2; i++ {
+		if r := probe(context.Background(), c); !r.Success {
+			t.Fatalf("probe failed: %s", r.Error)
+		}
+	}
+
+	messages := stub.receivedMessages(t)
+	if len(messages) != 2 {
+		t.Fatalf("%d messages received, want 2", len(messages))
+	}
+	ids := map[string]bool{}
+	for _, m := range messages {
+		id := m.Header.Get("Message-Id")
+		if !strings.HasSuffix(id, "@probes.example.org>") {
+			t.Errorf("Message-ID %q not of the configured domain", id)
+		}
+		ids[id] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("Message-IDs of two probes equal: %v", ids)
+	}
+}
+
+func TestRecursiveWatch(t *testing.T) {
+	stub := newSMTPStub(t)
+	root := t.TempDir()
+	nested := filepath.Join(root, "users", "probe")
+	content := strings.Replace(stubConfig(stub, "recursive", "watchrecursive: true"), filepath.Join(stub.maildir, "new"), root, 1)
+	c := detectConfig(t, content)[0]
+
+	// the maildir only appears once watching already began
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(nested, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// mails arriving before the new subdirectories are watched are found when adding the watches
+	stub.maildir = nested
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("mail in %s not detected watching %s: %s", filepath.Join(nested, "new"), root, r.Error)
+	}
+}
+
+func TestDetectedMailsKept(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := detectConfig(t, "disablefiledeletion: true\n"+stubConfig(stub, "kept"))[0]
+	late := testutil.ToFloat64(lateMails.WithLabelValues(c.Name))
+
+	for i := 1; i <= 2; i++ {
+		if r := probe(context.Background(), c); !r.Success {
+			t.Fatalf("probe %d failed: %s", i, r.Error)
+		}
+		files, err := os.ReadDir(filepath.Join(stub.maildir, "new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != i {
+			t.Errorf("%d mails left after %d probes, want all of them", len(files), i)
+		}
+	}
+	// the mail of the first probe kept is not taken for a late one of it
+	if v := testutil.ToFloat64(lateMails.WithLabelValues(c.Name)) - late; v != 0 {
+		t.Errorf("%g mails counted late", v)
+	}
+
+	// deleted by default
+	c = probeConfig(t, stub, "deleted")
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	files, _ := os.ReadDir(filepath.Join(stub.maildir, "new"))
+	if len(files) != 2 {
+		t.Errorf("%d mails left, want only the 2 kept before", len(files))
+	}
+}
+
+func TestMailDeliveredToCur(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.deliverTo = "cur" })
+	c := probeConfig(t, stub, "cur", "detectiondirs: ["+filepath.Join(stub.maildir, "cur")+"]")
+	if dirs := c.detectionDirs(); len(dirs) != 2 {
+		t.Fatalf("watching %q, want new and cur", dirs)
+	}
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("mail delivered to cur not detected: %s", r.Error)
+	}
+}
+
+func TestHelloName(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "hello", "helloname: probe.example.net")
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	if commands := stub.received(); len(commands) == 0 || commands[0] != "EHLO probe.example.net" {
+		t.Errorf("conversation not opened with the configured name: %q", commands)
+	}
+}
+
+func TestFromDisplayName(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "fromname", `fromname: "Mail Probe, Prod"`)
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	from, err := stub.receivedMessages(t)[0].Header.AddressList("From")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(from) != 1 || from[0].Name != "Mail Probe, Prod" || from[0].Address != "probe@example.com" {
+		t.Errorf("From-header parsed as %v", from)
+	}
+	// the envelope uses the bare address
+	if commands := stub.received(); !slices.Contains(commands, "MAIL FROM:<probe@example.com>") {
+		t.Errorf("envelope sender not the bare address: %q", commands)
+	}
+}
+
+func TestSlowDeliveryStillSucceeds(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.greetDelay = 50 * time.Millisecond })
+	c := probeConfig(t, stub, "slow", "warnduration: 10ms")
+	slow := testutil.ToFloat64(slowMails.WithLabelValues(c.Name))
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	if v := testutil.ToFloat64(slowMails.WithLabelValues(c.Name)) - slow; v != 1 {
+		t.Errorf("%g slow mails counted, want 1", v)
+	}
+	if v := testutil.ToFloat64(deliverOk.WithLabelValues(c.Name)); v != 1 {
+		t.Errorf("deliver_ok %g after slow delivery in time, want 1", v)
+	}
+}
+
+func TestProbeViaUnixSocket(t *testing.T) {
+	stub := listenSMTPStub(t, "unix", filepath.Join(t.TempDir(), "smtp.sock"))
+	c := probeConfig(t, stub, "socket")
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe via unix domain socket failed: %s", r.Error)
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	stub := newSMTPStub(t)
+	// all of 127.0.0.0/8 is local, so the stub is reached from any of them
+	for source, want := range map[string]string{"": "127.0.0.1", "127.0.0.2": "127.0.0.2", "127.0.0.3": "127.0.0.3"} {
+		var server []string
+		if source != "" {
+			server = append(server, "sourceaddress: "+source)
+		}
+		c := probeConfig(t, stub, "source", server...)
+		if r := probe(context.Background(), c); !r.Success {
+			t.Fatalf("probe from %q failed: %s", source, r.Error)
+		}
+
+		stub.mu.Lock()
+		client := stub.clients[len(stub.clients)-1]
+		stub.mu.Unlock()
+		host, _, _ := net.SplitHostPort(client)
+		if host != want {
+			t.Errorf("connected from %s with sourceaddress %q, want %s", host, source, want)
+		}
+	}
+
+	// the detection reads the config replaced here
+	stopDetection()
+	resetConfig(t)
+	if err := parseConfig([]string{writeConfig(t, stubConfig(stub, "source", "sourceaddress: relay.example.com"))}); err == nil || !strings.Contains(err.Error(), "sourceaddress") {
+		t.Errorf("sourceaddress not being an IP-address: got %v, want a config error", err)
+	}
+}
+
+func TestNetworkFamily(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6: %s", err)
+	} else {
+		ln.Close()
+	}
+
+	for i, tc := range []struct {
+		listen, server, network string
+		success                 bool
+	}{
+		{"127.0.0.1:0", "127.0.0.1", "tcp4", true},
+		{"127.0.0.1:0", "127.0.0.1", "tcp6", false},
+		{"[::1]:0", "::1", "tcp6", true},
+		{"[::1]:0", "::1", "tcp4", false},
+		// dual-stack
+		{"[::]:0", "127.0.0.1", "tcp4", true},
+		{"[::]:0", "::1", "tcp6", true},
+	} {
+		stub := listenSMTPStub(t, "tcp", tc.listen)
+		stub.host = tc.server
+		c := probeConfig(t, stub, fmt.Sprintf("family%d", i), "network: "+tc.network)
+
+		if r := probe(context.Background(), c); r.Success != tc.success {
+			t.Errorf("probe of %s listening on %s via %s ended with %+v, want success %t", tc.server, tc.listen, tc.network, r, tc.success)
+		}
+		if n := stub.connections(); n != 0 && !tc.success {
+			t.Errorf("%d connections to %s via %s, want none", n, tc.listen, tc.network)
+		}
+	}
+}
+
+func TestProbeViaTunnel(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.auth = "PLAIN" })
+	tunnel := newTunnel(t, net.JoinHostPort(stub.host, stub.port))
+	// the relay itself is never dialed, only named
+	stub.host = "relay.invalid"
+	c := probeConfig(t, stub, "tunneled", "tunnelvia: "+tunnel, "login: probe", "passphrase: secret")
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe via tunnel failed: %s", r.Error)
+	}
+	if v := testutil.ToFloat64(deliverOk.WithLabelValues(c.Name)); v != 1 {
+		t.Errorf("deliver_ok %g of the tunneled relay, want 1", v)
+	}
+	if !slices.ContainsFunc(stub.received(), func(cmd string) bool { return strings.HasPrefix(cmd, "AUTH PLAIN ") }) {
+		t.Errorf("no plain authentication through the tunnel in %q", stub.received())
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "headers", `headers: {X-Priority: "1", X-Probe-Group: canary}`)
+
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	header := stub.receivedMessages(t)[0].Header
+	if header.Get("X-Priority") != "1" || header.Get("X-Probe-Group") != "canary" {
+		t.Errorf("custom headers missing from %v", header)
+	}
+}
+
+func TestShutdownWithMailPending(t *testing.T) {
+	stub := newSMTPStub(t, func(s *smtpStub) { s.drop = true })
+	c := probeConfig(t, stub, "shutdown")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan probeResult)
+	go func() { done <- probe(ctx, c) }()
+
+	// wait for the mail to be sent and waited for
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(mailsInFlight.WithLabelValues(c.Name)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("probing-mail never in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// as on SIGTERM: the detection stops while the probe still waits
+	stopDetection()
+	cancel()
+	select {
+	case r := <-done:
+		if r.Error != context.Canceled.Error() {
+			t.Errorf("probe ended with %+v, want it cancelled", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("probe blocked on shutdown")
+	}
+	if v := testutil.ToFloat64(mailsInFlight.WithLabelValues(c.Name)); v != 0 {
+		t.Errorf("%g mails in flight after shutdown", v)
+	}
+}
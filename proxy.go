@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+// proxy returns the proxy-URL the SMTP-server of config c is dialed through,
+// overriding the global Proxy if set; empty for a direct connection.
+func (c smtpServerConfig) proxy() string {
+	if c.Proxy != "" {
+		return c.Proxy
+	}
+	return globalconf.Proxy
+}
+
+// proxyDialer returns a dialer connecting via the SOCKS5- or HTTP-proxy at rawurl,
+// reaching the proxy itself via forward.
+func proxyDialer(rawurl string, forward *net.Dialer) (proxy.ContextDialer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := proxy.FromURL(u, forward)
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer), nil
+}
+
+// httpConnectDialer tunnels connections through an HTTP-proxy via CONNECT.
+type httpConnectDialer struct {
+	addr    string
+	auth    string
+	forward proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &httpConnectDialer{addr: u.Host, forward: forward}
+	if u.Port() == "" {
+		d.addr = net.JoinHostPort(u.Hostname(), "8080")
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		d.auth = base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+	}
+	return d, nil
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if f, ok := d.forward.(proxy.ContextDialer); ok {
+		conn, err = f.DialContext(ctx, network, d.addr)
+	} else {
+		conn, err = d.forward.Dial(network, d.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// abort the handshake with the proxy as well if ctx is cancelled meanwhile
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	// the SMTP-greeting may already have been read along with the response
+	return bufferedConn{conn, r}, nil
+}
+
+// bufferedConn reads from r first, which holds data already read from Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
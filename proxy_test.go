@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// socksProxy is a SOCKS5-proxy on a local port requiring username and password,
+// connecting all clients to target whatever address they request.
+type socksProxy struct {
+	addr   string
+	target string
+
+	mu sync.Mutex
+	// addresses requested by clients authenticated, in order
+	requested []string
+}
+
+// newSOCKSProxy starts a socksProxy for user and pass until the test ends.
+func newSOCKSProxy(t *testing.T, target string, user string, pass string) *socksProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	p := &socksProxy{addr: ln.Addr().String(), target: target}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn, user, pass)
+		}
+	}()
+	return p
+}
+
+// serve runs the handshake of RFC 1928 and RFC 1929 on conn and relays it to the target.
+func (p *socksProxy) serve(conn net.Conn, user string, pass string) {
+	defer conn.Close()
+
+	// greeting: version, methods offered
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil || head[0] != 5 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 2}) // username/password
+
+	// authentication: version, username, password
+	if _, err := io.ReadFull(conn, head); err != nil || head[0] != 1 {
+		return
+	}
+	gotUser := make([]byte, head[1])
+	io.ReadFull(conn, gotUser)
+	n := make([]byte, 1)
+	io.ReadFull(conn, n)
+	gotPass := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, gotPass); err != nil {
+		return
+	}
+	if string(gotUser) != user || string(gotPass) != pass {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// request: version, CONNECT, reserved, address type, address, port
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil || req[1] != 1 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		io.ReadFull(conn, n)
+		name := make([]byte, n[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.requested = append(p.requested, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestProbeViaSOCKS5(t *testing.T) {
+	stub := newSMTPStub(t)
+	proxy := newSOCKSProxy(t, net.JoinHostPort(stub.host, stub.port), "probe", "secret")
+	// only resolvable by the proxy
+	stub.host = "relay.invalid"
+
+	c := probeConfig(t, stub, "socks", "proxy: socks5://probe:secret@"+proxy.addr)
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe via SOCKS5-proxy failed: %s", r.Error)
+	}
+	proxy.mu.Lock()
+	requested := proxy.requested
+	proxy.mu.Unlock()
+	if len(requested) != 1 || requested[0] != net.JoinHostPort("relay.invalid", stub.port) {
+		t.Errorf("proxy asked for %q, want only the server", requested)
+	}
+
+	c = probeConfig(t, stub, "socks-unauthorized", "proxy: socks5://probe:wrong@"+proxy.addr)
+	if r := probe(context.Background(), c); r.Success {
+		t.Error("probe via SOCKS5-proxy with wrong credentials succeeded")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushgatewayConfig describes a Prometheus Pushgateway the metrics are pushed to periodically,
+// for environments where scraping the HTTP-endpoint is not an option.
+type pushgatewayConfig struct {
+	// URL of the Pushgateway, e.g. http://pushgateway:9091.
+	URL string
+	// Job and instance the metrics are grouped by; "mailexporter" and the hostname if empty.
+	Job      string
+	Instance string
+	// The time between two pushes; defaults to 1m.
+	Interval time.Duration
+}
+
+// validate checks the settings of the Pushgateway and fills in the defaults.
+func (p *pushgatewayConfig) validate() error {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("url: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url: must be an http- or https-URL, got %q", p.URL)
+	}
+
+	if p.Job == "" {
+		p.Job = "mailexporter"
+	}
+	if p.Instance == "" {
+		if p.Instance, err = os.Hostname(); err != nil {
+			return fmt.Errorf("instance: %s", err)
+		}
+	}
+
+	if p.Interval == 0 {
+		p.Interval = time.Minute
+	} else if p.Interval < 0 {
+		return errors.New("interval must be positive")
+	}
+	return nil
+}
+
+// pushMetrics pushes all metrics to the Pushgateway every Interval until ctx is cancelled,
+// replacing the ones pushed before for the same job and instance.
+func pushMetrics(ctx context.Context, p pushgatewayConfig) {
+	pusher := push.New(p.URL, p.Job).Gatherer(registry).Grouping("instance", p.Instance)
+	slog.Info("Started pushing metrics", "url", p.URL, "job", p.Job, "instance", p.Instance)
+
+	for {
+		if err := pusher.Push(); err != nil {
+			slog.Warn("error pushing metrics to pushgateway", "url", p.URL, "err", err)
+		}
+		if !sleep(ctx, p.Interval) {
+			return
+		}
+	}
+}
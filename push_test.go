@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPushMetrics(t *testing.T) {
+	pushed := make(chan *http.Request, 1)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case pushed <- r:
+		default:
+		}
+	}))
+	defer gateway.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pushMetrics(ctx, pushgatewayConfig{URL: gateway.URL, Job: "mailexporter", Instance: "probe-host", Interval: time.Hour})
+		close(done)
+	}()
+
+	select {
+	case r := <-pushed:
+		if r.Method != http.MethodPut || r.URL.Path != "/metrics/job/mailexporter/instance/probe-host" {
+			t.Errorf("pushed via %s %s, want PUT grouped by job and instance", r.Method, r.URL.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("nothing pushed")
+	}
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sloConfig describes a service level objective on delivery durations, e.g. 95% of
+// all mails must be delivered in under 5s.
+type sloConfig struct {
+	// Percentage of deliveries (0-100] that must be faster than Threshold.
+	Percentile float64
+	// The delivery duration the given percentile of deliveries must stay below.
+	Threshold time.Duration
+}
+
+func (s sloConfig) String() string {
+	return fmt.Sprintf("p%g<%s", s.Percentile, s.Threshold)
+}
+
+var sloViolation = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mail_slo_violation",
+		Help: "indicator whether the delivery durations within the rolling window violate the SLO",
+	},
+	[]string{"configname", "slo"},
+)
+
+// durationWindow is a ring buffer holding the most recent delivery durations of one config.
+type durationWindow struct {
+	sync.Mutex
+	slos   []sloConfig
+	values []float64
+	next   int
+	full   bool
+}
+
+// durationWindows maps confignames to their windows; it is populated on startup only.
+var durationWindows = make(map[string]*durationWindow)
+
+// newDurationWindow returns a window for evaluating given SLOs over the last size durations.
+func newDurationWindow(slos []sloConfig, size int) *durationWindow {
+	return &durationWindow{slos: slos, values: make([]float64, size)}
+}
+
+// add records a delivery duration in seconds, overwriting the oldest one if the window is full.
+func (w *durationWindow) add(value float64) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.values[w.next] = value
+	w.next = (w.next + 1) % len(w.values)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// percentile returns the p-th percentile (nearest rank) of the durations in the window,
+// NaN if it is empty.
+func (w *durationWindow) percentile(p float64) float64 {
+	w.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.values)
+	}
+	sorted := make([]float64, n)
+	copy(sorted, w.values[:n])
+	w.Unlock()
+
+	if n == 0 {
+		return math.NaN()
+	}
+
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(n)))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// recordSLOTimeout records a mail of the given config that didn't arrive within its
+// timeout as a delivery slower than any threshold.
+func recordSLOTimeout(configname string) {
+	recordSLODuration(configname, math.Inf(1))
+}
+
+// recordSLODuration records a delivery duration in seconds for the given config
+// and re-evaluates its SLOs.
+func recordSLODuration(configname string, value float64) {
+	w, ok := durationWindows[configname]
+	if !ok {
+		return
+	}
+
+	w.add(value)
+	for _, slo := range w.slos {
+		if w.percentile(slo.Percentile) > slo.Threshold.Seconds() {
+			sloViolation.WithLabelValues(configname, slo.String()).Set(1)
+		} else {
+			sloViolation.WithLabelValues(configname, slo.String()).Set(0)
+		}
+	}
+}
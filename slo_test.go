@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTimeoutsViolateSLO(t *testing.T) {
+	slo := sloConfig{Percentile: 50, Threshold: 5 * time.Second}
+	durationWindows["slo-test"] = newDurationWindow([]sloConfig{slo}, 4)
+	t.Cleanup(func() { delete(durationWindows, "slo-test") })
+	violated := sloViolation.WithLabelValues("slo-test", slo.String())
+
+	recordSLODuration("slo-test", 1)
+	recordSLODuration("slo-test", 1)
+	if v := testutil.ToFloat64(violated); v != 0 {
+		t.Fatalf("violation %g after fast deliveries only", v)
+	}
+
+	recordSLOTimeout("slo-test")
+	recordSLOTimeout("slo-test")
+	if v := testutil.ToFloat64(violated); v != 0 {
+		t.Fatalf("violation %g with p50 still fast", v)
+	}
+	recordSLOTimeout("slo-test")
+	if v := testutil.ToFloat64(violated); v != 1 {
+		t.Fatalf("violation %g with most of the window timed out", v)
+	}
+}
+
+func TestSLOsEvaluatedIndependently(t *testing.T) {
+	median := sloConfig{Percentile: 50, Threshold: 2 * time.Second}
+	tail := sloConfig{Percentile: 95, Threshold: 2 * time.Second}
+	durationWindows["slo-test"] = newDurationWindow([]sloConfig{median, tail}, 10)
+	t.Cleanup(func() { delete(durationWindows, "slo-test") })
+
+	// one slow delivery out of ten only shows in the tail
+	for i := 0; i < 9; i++ {
+		recordSLODuration("slo-test", 1)
+	}
+	recordSLODuration("slo-test", 5)
+
+	if v := testutil.ToFloat64(sloViolation.WithLabelValues("slo-test", median.String())); v != 0 {
+		t.Errorf("%s violation %g with 9 of 10 deliveries taking 1s", median, v)
+	}
+	if v := testutil.ToFloat64(sloViolation.WithLabelValues("slo-test", tail.String())); v != 1 {
+		t.Errorf("%s violation %g with 1 of 10 deliveries taking 5s", tail, v)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tryConnect connects to the SMTP-server of c as a probe does and says goodbye,
+// returning the error of the first failing step.
+func tryConnect(c smtpServerConfig) error {
+	client, err := connect(context.Background(), c)
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func TestSMTPServerVerification(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t)
+	stub := newSMTPStub(t, func(s *smtpStub) {
+		s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	})
+
+	c := probeConfig(t, stub, "untrusted")
+	if err := tryConnect(c); classifySendError(err) != "tls" {
+		t.Errorf("certificate of an unknown CA: got %v, want a tls error", err)
+	}
+
+	c = probeConfig(t, stub, "skipverify", "insecureskipverify: true")
+	if err := tryConnect(c); err != nil {
+		t.Errorf("skipping verification: %s", err)
+	}
+
+	c = probeConfig(t, stub, "customca", "cafile: "+ca.file)
+	if err := tryConnect(c); err != nil {
+		t.Errorf("verifying against cafile: %s", err)
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, "relay.example.com")
+	stub := newSMTPStub(t, func(s *smtpStub) {
+		s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	})
+
+	c := probeConfig(t, stub, "noservername", "cafile: "+ca.file)
+	if err := tryConnect(c); classifySendError(err) != "tls" {
+		t.Errorf("certificate for another name than dialed: got %v, want a tls error", err)
+	}
+
+	c = probeConfig(t, stub, "servername", "cafile: "+ca.file, "tlsservername: relay.example.com")
+	if err := tryConnect(c); err != nil {
+		t.Fatalf("verifying for tlsservername: %s", err)
+	}
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.sni != "relay.example.com" {
+		t.Errorf("SNI %q, want the tlsservername", stub.sni)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t)
+	clients := x509.NewCertPool()
+	clients.AddCert(ca.cert)
+	stub := newSMTPStub(t, func(s *smtpStub) {
+		s.tls = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clients,
+		}
+	})
+
+	c := probeConfig(t, stub, "anonymous", "cafile: "+ca.file)
+	if r := probe(context.Background(), c); r.Success {
+		t.Fatal("probe without client certificate succeeded against a relay requiring one")
+	}
+	if n := len(stub.receivedMessages(t)); n != 0 {
+		t.Fatalf("%d mails accepted without client certificate", n)
+	}
+
+	certFile, keyFile := writeKeyPair(t, ca.issue(t, "probe.example.com"))
+	c = probeConfig(t, stub, "authenticated", "cafile: "+ca.file, "clientcertfile: "+certFile, "clientkeyfile: "+keyFile)
+	if r := probe(context.Background(), c); !r.Success {
+		t.Fatalf("probe with client certificate failed: %s", r.Error)
+	}
+}
+
+func TestClientCertificateUnloadable(t *testing.T) {
+	resetConfig(t)
+	stub := newSMTPStub(t)
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	err := parseConfig([]string{writeConfig(t, stubConfig(stub, "unloadable", "clientcertfile: "+missing, "clientkeyfile: "+missing))})
+	if err == nil || !strings.Contains(err.Error(), "clientcertfile") {
+		t.Errorf("unloadable client certificate: got %v, want a config error", err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// smtpStub is an SMTP-server on a local port delivering the mails it accepts into
+// a maildir of its own, for testing probes end to end.
+type smtpStub struct {
+	ln      net.Listener
+	host    string
+	port    string
+	maildir string
+
+	// accept mails without delivering them
+	drop bool
+	// subdirectory of the maildir to deliver to instead of new
+	deliverTo string
+	// delay before greeting clients
+	greetDelay time.Duration
+	// reply greeting clients instead of the usual 220
+	greeting string
+	// number of connections turned away as busy with 421 before serving any
+	busyConns int
+	// reply to RCPT instead of accepting the recipient
+	rcptReply string
+	// delay before accepting the data of a mail
+	dataDelay time.Duration
+	// offers STARTTLS with this config if set
+	tls *tls.Config
+	// SASL-mechanisms offered if set, any credentials being accepted
+	auth string
+	// rejects all credentials instead
+	rejectAuth bool
+
+	mu sync.Mutex
+	// server name sent via SNI on the last STARTTLS
+	sni string
+	// number of mails delivered, numbering their files
+	delivered int
+	// number of connections accepted
+	conns int
+	// addresses the connections accepted came from, in order
+	clients []string
+	// connections currently open
+	open map[net.Conn]bool
+	// connections turned away as busy so far
+	turnedAway int
+	// mails being accepted at the moment, and the most at once so far
+	accepting, mostAccepting int
+	// all commands received, in order
+	commands []string
+	// all messages received, in order
+	messages [][]byte
+}
+
+// newSMTPStub starts an SMTP-stub listening on a local port until the test ends,
+// with its behaviour adjusted by configure if given.
+func newSMTPStub(t *testing.T, configure ...func(*smtpStub)) *smtpStub {
+	t.Helper()
+	return listenSMTPStub(t, "tcp", "127.0.0.1:0", configure...)
+}
+
+// listenSMTPStub starts an SMTP-stub listening on address of network until the test ends,
+// with its behaviour adjusted by configure if given.
+func listenSMTPStub(t *testing.T, network string, address string, configure ...func(*smtpStub)) *smtpStub {
+	t.Helper()
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as given in the config of the server
+	host, port := "unix://"+address, "25"
+	if network != "unix" {
+		host, port, _ = net.SplitHostPort(ln.Addr().String())
+	}
+	s := &smtpStub{ln: ln, host: host, port: port, maildir: t.TempDir(), open: make(map[net.Conn]bool)}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.Mkdir(filepath.Join(s.maildir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range configure {
+		f(s)
+	}
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.clients = append(s.clients, conn.RemoteAddr().String())
+			s.open[conn] = true
+			s.mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(conn)
+				s.mu.Lock()
+				delete(s.open, conn)
+				s.mu.Unlock()
+			}()
+		}
+	}()
+
+	return s
+}
+
+// serve runs the SMTP-conversation on conn until the client quits or the connection breaks.
+func (s *smtpStub) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	text := textproto.NewConn(conn)
+	time.Sleep(s.greetDelay)
+	if s.greeting != "" {
+		text.PrintfLine("%s", s.greeting)
+		return
+	}
+	s.mu.Lock()
+	busy := s.turnedAway < s.busyConns
+	if busy {
+		s.turnedAway++
+	}
+	s.mu.Unlock()
+	if busy {
+		text.PrintfLine("421 too busy, try again later")
+		return
+	}
+	text.PrintfLine("220 stub ESMTP")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			extensions := []string{"stub"}
+			if _, secure := conn.(*tls.Conn); s.tls != nil && !secure {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if s.auth != "" {
+				extensions = append(extensions, "AUTH "+s.auth)
+			}
+			for i, ext := range extensions {
+				sep := "-"
+				if i == len(extensions)-1 {
+					sep = " "
+				}
+				text.PrintfLine("250%s%s", sep, ext)
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 ready")
+			secured := tls.Server(conn, s.tls)
+			if err := secured.Handshake(); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.sni = secured.ConnectionState().ServerName
+			s.mu.Unlock()
+			conn, text = secured, textproto.NewConn(secured)
+		case "AUTH":
+			if s.rejectAuth {
+				text.PrintfLine("535 authentication failed")
+			} else {
+				text.PrintfLine("235 authenticated")
+			}
+		case "RCPT":
+			if s.rcptReply != "" {
+				text.PrintfLine("%s", s.rcptReply)
+			} else {
+				text.PrintfLine("250 OK")
+			}
+		case "HELO", "MAIL", "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			msg, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.accepting++
+			s.mostAccepting = max(s.mostAccepting, s.accepting)
+			s.mu.Unlock()
+			time.Sleep(s.dataDelay)
+			s.mu.Lock()
+			s.accepting--
+			s.mu.Unlock()
+			if !s.drop {
+				if err := s.deliver(msg); err != nil {
+					text.PrintfLine("451 %s", err)
+					continue
+				}
+			}
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+// connections returns the number of connections accepted so far.
+func (s *smtpStub) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// hangUp closes all open connections, as servers do with idle ones.
+func (s *smtpStub) hangUp() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.open {
+		conn.Close()
+	}
+}
+
+// received returns the commands received so far.
+func (s *smtpStub) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// receivedMessages returns the messages received so far, parsed.
+func (s *smtpStub) receivedMessages(t *testing.T) []*mail.Message {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var messages []*mail.Message
+	for _, raw := range s.messages {
+		m, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// deliver stores msg in the maildir of the stub the way an MDA does, writing it
+// to tmp first and moving it to new once complete.
+func (s *smtpStub) deliver(msg []byte) error {
+	s.mu.Lock()
+	s.delivered++
+	name := fmt.Sprintf("%d.%d.stub", time.Now().UnixNano(), s.delivered)
+	s.mu.Unlock()
+
+	tmp := filepath.Join(s.maildir, "tmp", name)
+	if err := os.WriteFile(tmp, msg, 0600); err != nil {
+		return err
+	}
+	dir := "new"
+	if s.deliverTo != "" {
+		dir = s.deliverTo
+	}
+	return os.Rename(tmp, filepath.Join(s.maildir, dir, name))
+}
+
+// newTunnel forwards the connections accepted on a local port to target until the test
+// ends, like a TLS-tunnel does, and returns the address it listens on.
+func newTunnel(t *testing.T, target string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// stubConfig returns a config with a single server named name probing stub, amended by
+// the given YAML-lines of the server.
+func stubConfig(stub *smtpStub, name string, server ...string) string {
+	return "monitoringinterval: 1m\nmailchecktimeout: 5s\nservers:\n" + stubServer(stub, name, server...)
+}
+
+// stubServer returns the entry of the servers of a config for a server named name
+// probing stub, amended by the given YAML-lines.
+func stubServer(stub *smtpStub, name string, server ...string) string {
+	entry := fmt.Sprintf(`    - name: %s
+      server: %s
+      port: %s
+      from: probe@example.com
+      to: probe@example.com
+      detectiondir: %s
+`, name, stub.host, stub.port, filepath.Join(stub.maildir, "new"))
+	for _, line := range server {
+		entry += "      " + line + "\n"
+	}
+	return entry
+}
+
+// stopDetection stops the mail-detection started by probeConfig, nil if none is running.
+var stopDetection func()
+
+// detectionWatcher is the filesystem-watcher the mail-detection started by detectConfig began with.
+var detectionWatcher *fsnotify.Watcher
+
+// probeConfig parses the stubConfig of the given arguments and runs the mail-detection
+// until the test ends or probeConfig is called again.
+func probeConfig(t *testing.T, stub *smtpStub, name string, server ...string) smtpServerConfig {
+	t.Helper()
+	return detectConfig(t, stubConfig(stub, name, server...))[0]
+}
+
+// detectConfig parses the config content and runs the mail-detection for its servers
+// until the test ends or detectConfig is called again, returning the servers.
+func detectConfig(t *testing.T, content string) []smtpServerConfig {
+	t.Helper()
+	if stopDetection != nil {
+		// it reads the config replaced here
+		stopDetection()
+	}
+	resetConfig(t)
+
+	if err := parseConfig([]string{writeConfig(t, content)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range globalconf.Servers {
+		initMetrics(c)
+		initStatus(c.Name)
+	}
+
+	watcher, unwatched, err := newDetectionWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	detectionWatcher = watcher
+	// detectionStopped is closed by every run of the detection
+	detectionStopped = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go detectAndMuxMail(ctx, watcher, unwatched)
+	stopDetection = func() {
+		cancel()
+		<-detectionStopped
+		stopDetection = nil
+	}
+	t.Cleanup(func() {
+		if stopDetection != nil {
+			stopDetection()
+		}
+	})
+	return globalconf.Servers
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errorReasons are all values of the reason label of mail_last_error:
+// the reasons a send may fail for plus the delivery timing out.
+var errorReasons = append(append([]string{}, sendErrorReasons...), "deliver_timeout")
+
+var lastError = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mail_last_error",
+		Help: "indicator of the reason the last probe failed for, all 0 if it succeeded",
+	},
+	[]string{"configname", "reason"},
+)
+
+// startTime is when mailexporter started, from which the time since the last delivery
+// is counted as long as there was none.
+var startTime time.Time
+
+// sinceLastDelivery exports the time since the last delivery in time of every config,
+// computed on each scrape so that it is always current.
+type sinceLastDelivery struct {
+	desc *prometheus.Desc
+}
+
+var sinceLastDeliveryCollector = sinceLastDelivery{prometheus.NewDesc(
+	"mail_since_last_deliver_seconds",
+	"seconds since the last probing-mail delivered in time, or since startup if none was yet",
+	[]string{"configname"}, nil,
+)}
+
+func (c sinceLastDelivery) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c sinceLastDelivery) Collect(ch chan<- prometheus.Metric) {
+	statuses.Lock()
+	defer statuses.Unlock()
+
+	t := now()
+	for _, s := range statuses.servers {
+		last := startTime
+		if s.LastDeliverTime > 0 {
+			last = time.Unix(s.LastDeliverTime, 0)
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, t.Sub(last).Seconds(), s.Name)
+	}
+}
+
+// serverStatus is the outcome of the last probe of one config as reported on /status.
+type serverStatus struct {
+	Name string `json:"name"`
+	// whether the last probe was delivered in time
+	DeliverOk bool `json:"deliver_ok"`
+	// unix-timestamp of the last delivery in time, 0 if there was none yet
+	LastDeliverTime int64 `json:"last_deliver_time"`
+	// duration of the last delivery in time in seconds
+	LastDeliverDuration float64 `json:"last_deliver_duration_seconds"`
+	// the last error a probe failed with, retained after later successes
+	LastError string `json:"last_error,omitempty"`
+	// one of errorReasons
+	LastErrorReason string `json:"last_error_reason,omitempty"`
+	// unix-timestamp of the last error, 0 if there was none yet
+	LastErrorTime int64 `json:"last_error_time"`
+}
+
+// statuses holds the status of every config, kept in configuration order.
+var statuses = struct {
+	sync.Mutex
+	servers []serverStatus
+}{}
+
+// initStatus adds an empty status for the named config.
+func initStatus(name string) {
+	statuses.Lock()
+	defer statuses.Unlock()
+	statuses.servers = append(statuses.servers, serverStatus{Name: name})
+}
+
+// updateStatus applies update to the status of the named config.
+func updateStatus(name string, update func(*serverStatus)) {
+	statuses.Lock()
+	defer statuses.Unlock()
+
+	for i := range statuses.servers {
+		if statuses.servers[i].Name == name {
+			update(&statuses.servers[i])
+			return
+		}
+	}
+}
+
+// recordDelivery records a probe of the named config delivered in time with the given mail duration.
+func recordDelivery(name string, recv time.Time, duration time.Duration) {
+	updateStatus(name, func(s *serverStatus) {
+		s.DeliverOk = true
+		s.LastDeliverTime = recv.Unix()
+		s.LastDeliverDuration = duration.Seconds()
+	})
+	setLastError(name, "")
+}
+
+// recordTimeout records a probe of the named config that was not delivered in time.
+func recordTimeout(name string) {
+	recordError(name, "deliver_timeout", errDeliverTimeout.Error())
+}
+
+// recordError records a probe of the named config that failed with message for reason.
+func recordError(name string, reason string, message string) {
+	updateStatus(name, func(s *serverStatus) {
+		s.DeliverOk = false
+		s.LastError = message
+		s.LastErrorReason = reason
+		s.LastErrorTime = now().Unix()
+	})
+	setLastError(name, reason)
+}
+
+// setLastError sets mail_last_error of the named config to 1 for reason only, to 0 for all if empty.
+func setLastError(name string, reason string) {
+	for _, r := range errorReasons {
+		if r == reason {
+			lastError.WithLabelValues(name, r).Set(1)
+		} else {
+			lastError.WithLabelValues(name, r).Set(0)
+		}
+	}
+}
+
+// statusHandler serves the status of all configs as JSON.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	statuses.Lock()
+	body, err := json.Marshal(statuses.servers)
+	statuses.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
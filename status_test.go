@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSinceLastDelivery(t *testing.T) {
+	resetConfig(t)
+	start := time.Unix(1700000000, 0)
+	clock := fakeClock(t, start.Add(30*time.Second))
+	saved := startTime
+	startTime = start
+	t.Cleanup(func() { startTime = saved })
+
+	initStatus("delivered")
+	initStatus("undelivered")
+	updateStatus("delivered", func(s *serverStatus) { s.LastDeliverTime = start.Add(20 * time.Second).Unix() })
+
+	const head = `
+# HELP mail_since_last_deliver_seconds seconds since the last probing-mail delivered in time, or since startup if none was yet
+# TYPE mail_since_last_deliver_seconds gauge
+`
+	if err := testutil.CollectAndCompare(sinceLastDeliveryCollector, strings.NewReader(head+`
+mail_since_last_deliver_seconds{configname="delivered"} 10
+mail_since_last_deliver_seconds{configname="undelivered"} 30
+`)); err != nil {
+		t.Error(err)
+	}
+
+	*clock = clock.Add(time.Minute)
+	if err := testutil.CollectAndCompare(sinceLastDeliveryCollector, strings.NewReader(head+`
+mail_since_last_deliver_seconds{configname="delivered"} 70
+mail_since_last_deliver_seconds{configname="undelivered"} 90
+`)); err != nil {
+		t.Error(err)
+	}
+}
+
+// statusOf returns the status served for the named config, the only one configured.
+func statusOf(t *testing.T, name string) serverStatus {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var servers []serverStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &servers); err != nil {
+		t.Fatalf("invalid status %q: %s", rec.Body, err)
+	}
+	if len(servers) != 1 || servers[0].Name != name {
+		t.Fatalf("status of %+v, want only %s", servers, name)
+	}
+	return servers[0]
+}
+
+func TestStatusReflectsProbes(t *testing.T) {
+	stub := newSMTPStub(t)
+	c := probeConfig(t, stub, "status")
+	status := func() serverStatus { return statusOf(t, c.Name) }
+
+	before := time.Now().Unix()
+	r := probe(context.Background(), c)
+	if !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	s := status()
+	if !s.DeliverOk || s.LastDeliverTime < before || s.LastDeliverTime > time.Now().Unix() || s.LastDeliverDuration != r.DeliverDuration {
+		t.Errorf("status %+v after a successful probe taking %gs", s, r.DeliverDuration)
+	}
+	if v := testutil.ToFloat64(deliverOk.WithLabelValues(c.Name)); v != 1 {
+		t.Errorf("deliver_ok %g after a successful probe", v)
+	}
+
+	// failing to send agrees with mail_deliver_success just as well
+	stub.ln.Close()
+	stub.hangUp()
+	if r := probe(context.Background(), c); r.Success {
+		t.Fatal("probe of a server gone succeeded")
+	}
+	s = status()
+	if s.DeliverOk || s.LastErrorReason != "connect" {
+		t.Errorf("status %+v after failing to connect", s)
+	}
+	if v := testutil.ToFloat64(deliverOk.WithLabelValues(c.Name)); v != 0 {
+		t.Errorf("deliver_ok %g after failing to connect, want 0", v)
+	}
+}
+
+func TestLastErrorExported(t *testing.T) {
+	const name = "last-error"
+	lastErrorIs := func(want string) {
+		t.Helper()
+		for _, reason := range errorReasons {
+			v := testutil.ToFloat64(lastError.WithLabelValues(name, reason))
+			if reason == want && v != 1 || reason != want && v != 0 {
+				t.Errorf("mail_last_error for reason %s %g, want only %q set", reason, v, want)
+			}
+		}
+	}
+
+	rejecting := newSMTPStub(t, func(s *smtpStub) { s.rcptReply = "550 no such user" })
+	if r := probe(context.Background(), probeConfig(t, rejecting, name)); r.Success {
+		t.Fatal("probe rejected by the server succeeded")
+	}
+	lastErrorIs("5xx")
+	s := statusOf(t, name)
+	if s.LastErrorReason != "5xx" || !strings.Contains(s.LastError, "550") || !strings.Contains(s.LastError, "no such user") || s.LastErrorTime == 0 {
+		t.Errorf("status %+v after the recipient was rejected", s)
+	}
+
+	dropping := newSMTPStub(t, func(s *smtpStub) { s.drop = true })
+	if r := probe(context.Background(), probeConfig(t, dropping, name, "mailchecktimeout: 200ms")); r.Success {
+		t.Fatal("probe of a mail never delivered succeeded")
+	}
+	lastErrorIs("deliver_timeout")
+
+	if r := probe(context.Background(), probeConfig(t, newSMTPStub(t), name)); !r.Success {
+		t.Fatalf("probe failed: %s", r.Error)
+	}
+	lastErrorIs("")
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	auth "github.com/abbot/go-http-auth"
+	"gopkg.in/fsnotify.v1"
+)
+
+// authRealm is the realm announced to clients when asking for HTTP basic auth.
+const authRealm = "mailexporter"
+
+// authPassHash is the bcrypt-hash of the passphrase of the inline AuthUser,
+// either taken from the config or computed from the plaintext on startup.
+var authPassHash string
+
+// secret returns the provider for the credentials of users allowed to access the
+// HTTP-endpoint, nil if no authentication is configured.
+func secret() auth.SecretProvider {
+	if globalconf.HtpasswdFile != "" {
+		// the provider reloads the file on change, so users can be added without a restart
+		return auth.HtpasswdFileProvider(globalconf.HtpasswdFile)
+	}
+
+	if globalconf.AuthUser != "" {
+		return func(user, realm string) string {
+			if user == globalconf.AuthUser {
+				return authPassHash
+			}
+			return ""
+		}
+	}
+
+	return nil
+}
+
+// checkHtpasswd parses the htpasswd-file at path the way the htpasswd-provider does,
+// which panics on the first request instead of reporting malformed files.
+func checkHtpasswd(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comma = ':'
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		return errors.New("no users given")
+	}
+	for i, record := range records {
+		if len(record) != 2 || record[0] == "" || record[1] == "" {
+			return fmt.Errorf("entry %d: expected user:hash", i+1)
+		}
+	}
+	return nil
+}
+
+// protect wraps the given handler with HTTP basic auth if configured.
+// Client certificates take precedence over basic auth if required.
+func protect(h http.Handler) http.Handler {
+	if globalconf.ClientCAPath != "" {
+		// the TLS-handshake already made sure the client is one of ours
+		return h
+	}
+
+	secrets := secret()
+	if secrets == nil {
+		return h
+	}
+
+	authenticator := auth.NewBasicAuthenticator(authRealm, secrets)
+	return auth.JustCheck(authenticator, h.ServeHTTP)
+}
+
+// serverConfig returns the server config with the given name, if it exists.
+func serverConfig(name string) (smtpServerConfig, bool) {
+	for _, c := range globalconf.Servers {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return smtpServerConfig{}, false
+}
+
+// isConfigured tells if a server config with the given name exists.
+func isConfigured(name string) bool {
+	_, ok := serverConfig(name)
+	return ok
+}
+
+// maintenanceHandler lists the configs in maintenance on GET and toggles maintenance
+// for a config on POST via the parameters target=<name> and on=<true|false>.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		for _, c := range globalconf.Servers {
+			if inMaintenance(c.Name) {
+				fmt.Fprintln(w, c.Name)
+			}
+		}
+	case http.MethodPost:
+		target := r.URL.Query().Get("target")
+		if !isConfigured(target) {
+			http.Error(w, "unknown target "+strconv.Quote(target), http.StatusNotFound)
+			return
+		}
+
+		on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+		if err != nil {
+			http.Error(w, "parameter on must be true or false", http.StatusBadRequest)
+			return
+		}
+
+		setMaintenance(target, on)
+		slog.Info("maintenance toggled", "config", target, "on", on)
+		fmt.Fprintf(w, "%s: maintenance %t\n", target, on)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// probeHandler runs a probe of the config given by parameter config on POST right away,
+// waiting for it to complete, and reports its outcome as JSON. The probe is recorded in
+// the metrics like any other; a failed one is answered with 503.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("config")
+	c, ok := serverConfig(name)
+	if !ok {
+		http.Error(w, "unknown config "+strconv.Quote(name), http.StatusNotFound)
+		return
+	}
+
+	slog.Info("probe triggered via HTTP", "config", name)
+	// cancelled if the client gives up waiting
+	result := probe(r.Context(), c)
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Success {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+// healthyHandler tells that the HTTP-endpoint is serving, for liveness checks of orchestrators
+// or load balancers; unlike mailexporter_up it doesn't depend on the exporter's subsystems.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Healthy")
+}
+
+// authEnabled tells if clients of the HTTP-endpoint have to authenticate,
+// either by basic auth or by a client certificate.
+func authEnabled() bool {
+	return globalconf.ClientCAPath != "" || globalconf.HtpasswdFile != "" || globalconf.AuthUser != ""
+}
+
+// newMux sets up the handlers of all endpoints, serving metrics under path.
+// The health-endpoint is left unauthenticated, all others are protected as configured.
+// The endpoints changing state or sending mail are only served if auth is configured.
+func newMux(path string, metrics http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(path, protect(metrics))
+	mux.Handle("/status", protect(http.HandlerFunc(statusHandler)))
+	if authEnabled() {
+		mux.Handle("/maintenance", protect(http.HandlerFunc(maintenanceHandler)))
+		mux.Handle("/probe", protect(http.HandlerFunc(probeHandler)))
+	} else {
+		slog.Info("no auth configured, not serving /maintenance and /probe")
+	}
+	mux.HandleFunc("/-/healthy", healthyHandler)
+	return mux
+}
+
+// listenAddress returns the address the HTTP-endpoint shall listen on.
+func listenAddress() string {
+	if globalconf.ListenAddress != "" {
+		return globalconf.ListenAddress
+	}
+	return *webListenAddress
+}
+
+// tlsEnabled tells if the HTTP-endpoint is to be served via TLS.
+func tlsEnabled() bool {
+	return globalconf.CrtPath != "" && globalconf.KeyPath != "" || globalconf.GenerateSelfSignedCert
+}
+
+// tlsVersions maps the accepted values of TLSMinVersion to their protocol versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersion returns the TLS protocol version of the given name, e.g. "1.2".
+func tlsVersion(name string) (uint16, error) {
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, must be one of 1.0, 1.1, 1.2, 1.3", name)
+	}
+	return v, nil
+}
+
+// cipherSuites returns the IDs of the cipher suites of the given names, nil if none are given.
+// Only suites considered secure by Go are accepted.
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// certReloader serves the certificate at crtPath and keyPath, reloading it
+// whenever one of them changes so that rotated certificates need no restart.
+type certReloader struct {
+	crtPath string
+	keyPath string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads the certificate at crtPath and keyPath and starts watching it for changes.
+func newCertReloader(crtPath string, keyPath string) (*certReloader, error) {
+	r := &certReloader{crtPath: crtPath, keyPath: keyPath}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// the directories are watched as tools like cert-manager replace the files
+	// (or symlinks to them) instead of writing to them
+	for _, dir := range []string{filepath.Dir(crtPath), filepath.Dir(keyPath)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	go r.watch(watcher)
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.crtPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// watch reloads the certificate on any change within its directories. A failing reload,
+// e.g. while only one of both files has been replaced yet, keeps the previous certificate.
+func (r *certReloader) watch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case <-watcher.Events:
+			if err := r.load(); err != nil {
+				slog.Debug("not reloading certificate", "err", err)
+				continue
+			}
+			slog.Debug("reloaded certificate", "file", r.crtPath)
+		case err := <-watcher.Errors:
+			slog.Warn("certificate-watcher-error", "err", err)
+		}
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// selfSignedCertValidity is how long generated self-signed certificates are valid.
+const selfSignedCertValidity = 365 * 24 * time.Hour
+
+// generateSelfSignedCert returns a self-signed certificate for localhost and the hostname,
+// kept in memory only.
+func generateSelfSignedCert() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+
+	t := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "mailexporter"},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    t.Add(-time.Hour), // tolerate clients with slightly skewed clocks
+		NotAfter:     t.Add(selfSignedCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// newServer builds the HTTP-server serving handler on addr, set up with the configured
+// TLS-parameters and to require client certificates if configured.
+func newServer(addr string, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	if !tlsEnabled() {
+		return srv, nil
+	}
+
+	minVersion, err := tlsVersion(globalconf.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	suites, err := cipherSuites(globalconf.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.TLSConfig = &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+	}
+
+	if globalconf.GenerateSelfSignedCert {
+		cert, err := generateSelfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn("serving HTTP-endpoint with a generated self-signed certificate, not meant for production")
+		srv.TLSConfig.Certificates = []tls.Certificate{*cert}
+	} else {
+		certs, err := newCertReloader(globalconf.CrtPath, globalconf.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig.GetCertificate = certs.getCertificate
+	}
+
+	if globalconf.ClientCAPath != "" {
+		pem, err := ioutil.ReadFile(globalconf.ClientCAPath)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid certificates found in " + globalconf.ClientCAPath)
+		}
+
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return srv, nil
+}
+
+// serve runs srv via TLS if enabled and plain HTTP otherwise.
+func serve(srv *http.Server) error {
+	if tlsEnabled() {
+		// the certificate is provided by TLSConfig
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
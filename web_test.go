@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setAuthUser protects the HTTP-endpoint with basic auth for user with passphrase pass
+// until the test ends.
+func setAuthUser(t *testing.T, user string, pass string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalconf.AuthUser = user
+	authPassHash = string(hash)
+	t.Cleanup(func() { authPassHash = "" })
+}
+
+// requestAs sends a request with the given basic auth credentials to h, without any if user is empty.
+func requestAs(h http.Handler, method string, target string, user string, pass string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHtpasswdFileParsedOnStartup(t *testing.T) {
+	for content, valid := range map[string]bool{
+		"# users\nprom:$2y$05$Ix0b1V6cU1ENkx4sqBgPOu0gqY3Rj5D8xEV3EDMsxvXQxyH5QZ2Ry\n": true,
+		"prom:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\nother:$apr1$x$y\n":                    true,
+		"":                  false,
+		"# nobody\n":        false,
+		"prom\n":            false,
+		"prom:hash:extra\n": false,
+		"prom:\n":           false,
+		"a:hash\nb\n":       false,
+		"\"prom:hash\n":     false,
+	} {
+		resetConfig(t)
+		globalconf.MonitoringInterval = time.Minute
+		globalconf.MailCheckTimeout = time.Minute
+		globalconf.HtpasswdFile = writeConfig(t, content)
+		err := validateConfig()
+		if valid && err != nil {
+			t.Errorf("htpasswd-file %q rejected: %s", content, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("htpasswd-file %q accepted", content)
+		}
+	}
+
+	resetConfig(t)
+	globalconf.MonitoringInterval = time.Minute
+	globalconf.MailCheckTimeout = time.Minute
+	globalconf.HtpasswdFile = "/nonexistent/htpasswd"
+	if validateConfig() == nil {
+		t.Error("missing htpasswd-file accepted")
+	}
+}
+
+func TestHtpasswdFileAuthenticates(t *testing.T) {
+	resetConfig(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {SHA} is the base64-encoded SHA-1 of "sha-secret"
+	globalconf.HtpasswdFile = writeConfig(t, "# users\nprom:"+string(hash)+"\nlegacy:{SHA}KkPcK3XYeA35EhWhKYmaCyAgadY=\n")
+	globalconf.MonitoringInterval = time.Minute
+	globalconf.MailCheckTimeout = time.Minute
+	if err := validateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	mux := newMux("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		user, pass string
+		want       int
+	}{
+		{"prom", "bcrypt-secret", http.StatusOK},
+		{"legacy", "sha-secret", http.StatusOK},
+		{"prom", "wrong", http.StatusUnauthorized},
+		{"legacy", "bcrypt-secret", http.StatusUnauthorized},
+		{"unknown", "bcrypt-secret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		if rec := requestAs(mux, http.MethodGet, "/metrics", tc.user, tc.pass); rec.Code != tc.want {
+			t.Errorf("%s:%s answered with %d, want %d", tc.user, tc.pass, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestInlinePassphrase(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { authPassHash = "" })
+
+	for name, configure := range map[string]func(){
+		"authpasshash": func() { globalconf.AuthPassHash = string(hash) },
+		"authpass":     func() { globalconf.AuthPass = "secret" },
+	} {
+		resetConfig(t)
+		authPassHash = ""
+		globalconf.MonitoringInterval = time.Minute
+		globalconf.MailCheckTimeout = time.Minute
+		globalconf.AuthUser = "prom"
+		configure()
+		if err := validateConfig(); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if strings.Contains(authPassHash, "secret") {
+			t.Errorf("%s: plaintext kept as hash", name)
+		}
+
+		mux := newMux("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		if rec := requestAs(mux, http.MethodGet, "/metrics", "prom", "secret"); rec.Code != http.StatusOK {
+			t.Errorf("%s: right passphrase answered with %d", name, rec.Code)
+		}
+		if rec := requestAs(mux, http.MethodGet, "/metrics", "prom", "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: wrong passphrase answered with %d", name, rec.Code)
+		}
+	}
+
+	resetConfig(t)
+	globalconf.MonitoringInterval = time.Minute
+	globalconf.MailCheckTimeout = time.Minute
+	globalconf.AuthUser = "prom"
+	globalconf.AuthPassHash = "secret"
+	if validateConfig() == nil {
+		t.Error("authpasshash that is no bcrypt-hash accepted")
+	}
+}
+
+func TestStateChangingRoutesNeedAuth(t *testing.T) {
+	resetConfig(t)
+	mux := newMux("/metrics", http.NotFoundHandler())
+	for _, path := range []string{"/maintenance", "/probe"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s served without auth: %d", path, rec.Code)
+		}
+	}
+
+	setAuthUser(t, "prom", "secret")
+	mux = newMux("/metrics", http.NotFoundHandler())
+	for _, path := range []string{"/maintenance", "/probe"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s not protected by basic auth: %d", path, rec.Code)
+		}
+	}
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	resetConfig(t)
+	globalconf.Servers = []smtpServerConfig{{Name: "relay"}}
+	setAuthUser(t, "prom", "secret")
+	t.Cleanup(func() { setMaintenance("relay", false) })
+	mux := newMux("/metrics", http.NotFoundHandler())
+
+	for _, on := range []bool{true, false} {
+		rec := requestAs(mux, http.MethodPost, fmt.Sprintf("/maintenance?target=relay&on=%t", on), "prom", "secret")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("toggling maintenance %t answered with %d", on, rec.Code)
+		}
+		want := 0.0
+		if on {
+			want = 1
+		}
+		if v := testutil.ToFloat64(mailMaintenance.WithLabelValues("relay")); v != want {
+			t.Errorf("mail_maintenance %g after toggling it %t", v, on)
+		}
+		listed := requestAs(mux, http.MethodGet, "/maintenance", "prom", "secret").Body.String()
+		if strings.Contains(listed, "relay") != on {
+			t.Errorf("configs in maintenance %q after toggling it %t", listed, on)
+		}
+	}
+
+	if rec := requestAs(mux, http.MethodPost, "/maintenance?target=unknown&on=true", "prom", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("maintenance of an unknown config answered with %d", rec.Code)
+	}
+	if rec := requestAs(mux, http.MethodPost, "/maintenance?target=relay&on=maybe", "prom", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("maintenance neither on nor off answered with %d", rec.Code)
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	stub := newSMTPStub(t)
+	probeConfig(t, stub, "ondemand")
+	setAuthUser(t, "prom", "secret")
+	mux := newMux("/metrics", http.NotFoundHandler())
+
+	request := func(method string, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.SetBasicAuth("prom", "secret")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request(http.MethodPost, "/probe?config=ondemand")
+	var result probeResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("status %d, invalid JSON %q: %s", rec.Code, rec.Body, err)
+	}
+	if rec.Code != http.StatusOK || !result.Success || result.Name != "ondemand" {
+		t.Errorf("status %d, result %+v, want a successful probe", rec.Code, result)
+	}
+
+	if rec := request(http.MethodPost, "/probe?config=unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("probe of an unknown config answered with %d", rec.Code)
+	}
+	if rec := request(http.MethodGet, "/probe?config=ondemand"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET answered with %d", rec.Code)
+	}
+}
+
+func TestHealthyUnprotected(t *testing.T) {
+	resetConfig(t)
+	setAuthUser(t, "prom", "secret")
+	mux := newMux("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for path, want := range map[string]int{
+		"/metrics":   http.StatusUnauthorized,
+		"/-/healthy": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s without credentials answered with %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("prom", "secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("/metrics with credentials answered with %d", rec.Code)
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	resetConfig(t)
+	globalconf.GenerateSelfSignedCert = true
+	globalconf.TLSMinVersion = "1.2"
+
+	srv, err := newServer("", newMux("/metrics", http.NotFoundHandler()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	// trust the generated certificate only
+	leaf, err := x509.ParseCertificate(srv.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}}}
+
+	resp, err := client.Get("https://" + ln.Addr().String() + "/-/healthy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	resetConfig(t)
+	ca := newTestCA(t)
+	globalconf.GenerateSelfSignedCert = true
+	globalconf.ClientCAPath = ca.file
+	globalconf.TLSMinVersion = "1.2"
+
+	srv, err := newServer("", newMux("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	leaf, err := x509.ParseCertificate(srv.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := x509.NewCertPool()
+	servers.AddCert(leaf)
+	get := func(certs ...tls.Certificate) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: servers, ServerName: "localhost", Certificates: certs}}}
+		resp, err := client.Get("https://" + ln.Addr().String() + "/metrics")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	if err := get(ca.issue(t, "prometheus")); err != nil {
+		t.Errorf("client certificate of the CA rejected: %s", err)
+	}
+	if err := get(newTestCA(t).issue(t, "prometheus")); err == nil {
+		t.Error("client certificate of another CA accepted")
+	}
+	if err := get(); err == nil {
+		t.Error("client without certificate accepted")
+	}
+}
+
+func TestCertificateReloaded(t *testing.T) {
+	resetConfig(t)
+	ca := newTestCA(t)
+	old, renewed := ca.issue(t), ca.issue(t)
+	globalconf.CrtPath, globalconf.KeyPath = writeKeyPair(t, old)
+	globalconf.TLSMinVersion = "1.2"
+
+	srv, err := newServer("", newMux("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the certificate is reloaded from where it was configured at startup
+	crtPath, keyPath := globalconf.CrtPath, globalconf.KeyPath
+	globalconf.CrtPath, globalconf.KeyPath = "", ""
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	served := func() []byte {
+		t.Helper()
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	if !bytes.Equal(served(), old.Certificate[0]) {
+		t.Fatal("configured certificate not served")
+	}
+
+	// replaced like cert-manager does, the key first
+	newCrt, newKey := writeKeyPair(t, renewed)
+	if err := os.Rename(newKey, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newCrt, crtPath); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(served(), renewed.Certificate[0]) {
+		if time.Now().After(deadline) {
+			t.Fatal("replaced certificate never served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	for _, tc := range []struct {
+		min      string
+		accepted bool
+	}{
+		{"1.2", false},
+		{"1.0", true},
+	} {
+		resetConfig(t)
+		globalconf.GenerateSelfSignedCert = true
+		globalconf.TLSMinVersion = tc.min
+
+		srv, err := newServer("", newMux("/metrics", http.NotFoundHandler()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.ServeTLS(ln, "", "")
+		defer srv.Close()
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS10,
+			MaxVersion:         tls.VersionTLS10,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		if accepted := err == nil; accepted != tc.accepted {
+			t.Errorf("TLS 1.0 handshake with tlsminversion %s: accepted %t, error %v", tc.min, accepted, err)
+		}
+	}
+}
+
+func TestCipherSuitesValidated(t *testing.T) {
+	if _, err := cipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}); err != nil {
+		t.Errorf("secure cipher suite rejected: %s", err)
+	}
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "bogus"} {
+		if _, err := cipherSuites([]string{name}); err == nil {
+			t.Errorf("cipher suite %s accepted", name)
+		}
+	}
+}